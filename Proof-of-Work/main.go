@@ -5,10 +5,11 @@ import (
 
 	"bufio"
 	"context"
+	"encoding/hex"
+	"flag"
 	"log"
 	"os"
 	"strings"
-	"sync"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -21,11 +22,52 @@ import (
 )
 
 var (
-	app = src.NewApp()
-	mutex = &sync.Mutex{}
+	app src.App // created once the flags are parsed
 )
 
 func main() {
+	blockTime := flag.Duration("block-time", src.TARGET_BLOCK_TIME,
+		"mean block interval the difficulty retargets to")
+	retarget := flag.Int("retarget", src.RETARGET_INTERVAL,
+		"number of blocks between two difficulty retargets")
+	workers := flag.Int("workers", src.WORKERS,
+		"number of goroutines mining in parallel")
+	restart := flag.Bool("restart", src.RESTART_MINING,
+		"restart mining on the new tip when a competing block arrives")
+	mine := flag.Bool("mine", false,
+		"keep mining blocks in the background from startup")
+	dataTemplate := flag.String("data", src.DATA_TEMPLATE,
+		"payload of a transaction put into every auto-mined block, {round} is replaced by the round")
+	miningLog := flag.String("mining-log", src.MINING_LOG,
+		"file the mining stats of every block are appended to as JSON lines")
+	pow := flag.String("pow", src.POW.Name(),
+		"proof-of-work hash function: sha256, sha256d, scrypt or argon2id")
+	difficulty := flag.String("difficulty", hex.EncodeToString(src.DIFFICULTY),
+		"target of the genesis block as a hex prefix, padded with zeros")
+	finality := flag.Int("finality", src.FINALITY_DEPTH,
+		"confirmations after which a block counts as final")
+	ghost := flag.Bool("ghost", src.GHOST,
+		"GHOST fork choice: follow the heaviest subtree instead of the heaviest chain")
+	selfish := flag.Bool("selfish", src.SELFISH_MINING,
+		"selfish mining: withhold mined blocks and release them as honest blocks arrive")
+	maxBlockTxs := flag.Int("max-block-txs", src.MAX_BLOCK_TXS,
+		"transactions a new block takes from the mempool at most")
+	flag.Parse()
+	src.TARGET_BLOCK_TIME, src.RETARGET_INTERVAL = *blockTime, *retarget
+	src.WORKERS, src.RESTART_MINING = *workers, *restart
+	src.DATA_TEMPLATE, src.MINING_LOG = *dataTemplate, *miningLog
+	src.MAX_BLOCK_TXS, src.SELFISH_MINING = *maxBlockTxs, *selfish
+	src.GHOST, src.FINALITY_DEPTH = *ghost, *finality
+	if src.POW = src.POW_FUNCTIONS[*pow]; src.POW == nil {
+		log.Fatalf("error: unknown proof-of-work function %s", *pow)
+	}
+	genesisTarget, err := hex.DecodeString(*difficulty)
+	if err != nil || len(genesisTarget) > 32 {
+		log.Fatalf("error: invalid difficulty %s", *difficulty)
+	}
+	src.DIFFICULTY = genesisTarget
+	app = src.NewApp()
+
 	go func ()  {
 		log.Print(http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -54,12 +96,12 @@ func main() {
 	addrs, _ := peer.AddrInfoToP2pAddrs(&peerInfo)
 	log.Printf("node address: %s", addrs[0])
 
-	if len(os.Args) > 1 {
+	if flag.NArg() > 0 {
 		log.Printf("info: sending init event")
 		var addr ma.Multiaddr
 		var pi *peer.AddrInfo
-		for i := 1; i < len(os.Args); i++ {
-			addr, _ = ma.NewMultiaddr(os.Args[i])
+		for _, arg := range flag.Args() {
+			addr, _ = ma.NewMultiaddr(arg)
 			pi, _ = peer.AddrInfoFromP2pAddr(addr)
 			if err := host.Connect(context.Background(), *pi); err != nil {
 				log.Printf("error: can connect")
@@ -72,9 +114,7 @@ func main() {
 			} else {
 				rw := bufio.NewReadWriter(
 					bufio.NewReader(s), bufio.NewWriter(s))
-				mutex.Lock()
-				src.READWRITERS = append(src.READWRITERS, rw)
-				mutex.Unlock()
+				src.AddReadWriter(rw)
 
 				go app.InjectEvent(rw)
 			}
@@ -83,30 +123,53 @@ func main() {
 		log.Printf("info: connected nodes: %d", peers.Len()-1)
 	}
 
+	if *mine {
+		app.StartMining(src.DATA_TEMPLATE)
+	}
+
 	scanner := bufio.NewScanner(os.Stdin)
 	var cmd string
-	for {
-		scanner.Scan()
+	for scanner.Scan() {
 		cmd = scanner.Text()
 		if cmd == "ls p" {
 			src.HandlePrintPeers(host)
 		} else if cmd == "ls c" {
 			src.HandlePrintChains(&app)
-		} else if strings.HasPrefix(cmd, "create b ") {
+		} else if cmd == "ls f" {
+			src.HandlePrintForks(&app)
+		} else if cmd == "chainwork" {
+			src.HandlePrintChainWork(&app)
+		} else if cmd == "ls tx" {
+			src.HandlePrintMempool(&app)
+		} else if cmd == "balance" || strings.HasPrefix(cmd, "balance ") {
+			src.HandleBalance(cmd, &app)
+		} else if strings.HasPrefix(cmd, "send tx ") {
+			src.HandleSendTransaction(cmd, &app)
+		} else if cmd == "create b" || strings.HasPrefix(cmd, "create b ") {
 			src.HandleCreateBlock(cmd, &app)
+		} else if strings.HasPrefix(cmd, "mine ") {
+			src.HandleMine(cmd, &app)
+		} else if strings.HasPrefix(cmd, "bench ") {
+			src.HandleBench(cmd, &app)
+		} else if strings.HasPrefix(cmd, "status ") {
+			src.HandleStatus(cmd, &app)
+		} else if cmd == "ls times" {
+			src.HandlePrintTimes(&app)
+		} else if strings.HasPrefix(cmd, "export times ") {
+			src.HandleExportTimes(cmd, &app)
 		} else {
 			log.Printf("error: unknown command")
 		}
 	}
+	// stdin is closed, keep serving peers and mining in the background
+	select {}
 }
 
 func handleStream(s network.Stream) {
 	log.Printf("info: get new Stream %s", s.ID())
 	rw := bufio.NewReadWriter(
 		bufio.NewReader(s), bufio.NewWriter(s))
-	mutex.Lock()
-	src.READWRITERS = append(src.READWRITERS, rw)
-	mutex.Unlock()
+	src.AddReadWriter(rw)
 	log.Printf("info: sending local chain to %s", s.Conn().RemotePeer())
 	src.Publish(src.ChainResponse{
 		Blocks: app.Blocks,
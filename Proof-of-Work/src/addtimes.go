@@ -0,0 +1,149 @@
+package src
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AddTime records how a block went through tryAddBlock
+type AddTime struct {
+	Round      int    `json:"round"`
+	Hash       string `json:"hash"`
+	Created    bool   `json:"created"`     // by us, otherwise received from a peer
+	ReceivedAt int64  `json:"received_at"` // unix milliseconds, when it was received or created
+	AddedAt    int64  `json:"added_at"`    // unix milliseconds
+	IntervalMs int64  `json:"interval_ms"` // since the previous block was added
+}
+
+// AddTimeStats summarizes the intervals between added blocks
+type AddTimeStats struct {
+	Count    int     `json:"count"`
+	MinMs    int64   `json:"min_ms"`
+	MeanMs   float64 `json:"mean_ms"`
+	MaxMs    int64   `json:"max_ms"`
+	StddevMs float64 `json:"stddev_ms"` // sample standard deviation
+}
+
+// AddTimes keeps an AddTime for every block added to the tree. Blocks
+// are received before they can be added, orphans possibly long before.
+type AddTimes struct {
+	records []AddTime
+	pending map[string]time.Time // received but not added yet, by hash
+	last    time.Time            // the previous block was added, or we started
+}
+
+func newAddTimes() *AddTimes {
+	return &AddTimes{[]AddTime{}, make(map[string]time.Time), time.Now()}
+}
+
+// receive notes that block reached us at t, unless it already did
+func (times *AddTimes) receive(block Block, t time.Time) {
+	hash := hex.EncodeToString(hashBlock(block))
+	if _, isPending := times.pending[hash]; !isPending {
+		times.pending[hash] = t
+	}
+}
+
+// add records that block was just added to the tree
+func (times *AddTimes) add(block Block) {
+	now := time.Now()
+	hash := hex.EncodeToString(hashBlock(block))
+	received, isPending := times.pending[hash]
+	if !isPending {
+		received = now
+	}
+	delete(times.pending, hash)
+	times.records = append(times.records, AddTime{
+		block.Round,
+		hash,
+		blockProducer(block) == PEER_ID,
+		received.UnixMilli(),
+		now.UnixMilli(),
+		now.Sub(times.last).Milliseconds(),
+	})
+	times.last = now
+}
+
+// prune forgets the received blocks that were neither added nor kept as
+// orphans
+func (times *AddTimes) prune(orphans []Block) {
+	if len(times.pending) == 0 {
+		return
+	}
+	kept := make(map[string]time.Time)
+	for _, orphan := range orphans {
+		hash := hex.EncodeToString(hashBlock(orphan))
+		if t, isPending := times.pending[hash]; isPending {
+			kept[hash] = t
+		}
+	}
+	times.pending = kept
+}
+
+func (times *AddTimes) stats() AddTimeStats {
+	stats := AddTimeStats{Count: len(times.records)}
+	if stats.Count == 0 {
+		return stats
+	}
+	stats.MinMs, stats.MaxMs = math.MaxInt64, math.MinInt64
+	sum := 0.0
+	for _, r := range times.records {
+		if r.IntervalMs < stats.MinMs {
+			stats.MinMs = r.IntervalMs
+		}
+		if r.IntervalMs > stats.MaxMs {
+			stats.MaxMs = r.IntervalMs
+		}
+		sum += float64(r.IntervalMs)
+	}
+	stats.MeanMs = sum / float64(stats.Count)
+	if stats.Count > 1 {
+		squares := 0.0
+		for _, r := range times.records {
+			d := float64(r.IntervalMs) - stats.MeanMs
+			squares += d * d
+		}
+		stats.StddevMs = math.Sqrt(squares / float64(stats.Count-1))
+	}
+	return stats
+}
+
+// export writes the records to filename, as CSV if it ends in .csv and
+// as JSON lines otherwise
+func (times *AddTimes) export(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(filename, ".csv") {
+		w := csv.NewWriter(file)
+		w.Write([]string{"round", "hash", "created", "received_at", "added_at", "interval_ms"})
+		for _, r := range times.records {
+			w.Write([]string{
+				strconv.Itoa(r.Round),
+				r.Hash,
+				strconv.FormatBool(r.Created),
+				strconv.FormatInt(r.ReceivedAt, 10),
+				strconv.FormatInt(r.AddedAt, 10),
+				strconv.FormatInt(r.IntervalMs, 10),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	enc := json.NewEncoder(file)
+	for _, r := range times.records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,19 +1,41 @@
 package src
 
 import (
+	"context"
 	"encoding/hex"
 	"log"
 	"bytes"
-	"encoding/json"
 	"crypto/sha256"
+	"time"
 )
 
+var GHOST = false // choose the main chain by subtree weight, see ghostTip
+
 type App struct {
-	Blocks []Block `json:"blocks"`
+	Blocks     []Block            `json:"blocks"` // the main chain, genesis to tip
+	Tree       *BlockTree         `json:"-"`
+	Reorgs     []Reorg            `json:"reorgs"`
+	Ledger     *Ledger            `json:"-"`
+	Mempool    *Mempool           `json:"-"`
+	Times      *AddTimes          `json:"-"`
+	selfish    *selfishMiner      // our private chain if SELFISH_MINING
+	tip        chan struct{}      // closed and replaced whenever the tip changes
+	stopMining context.CancelFunc // stops the auto-miner, nil if not mining
 }
 
 func NewApp() App {
-	app := &App{make([]Block, 0)}
+	ledger := newLedger()
+	app := &App{
+		make([]Block, 0),
+		nil,
+		[]Reorg{},
+		ledger,
+		newMempool(ledger),
+		newAddTimes(),
+		&selfishMiner{},
+		make(chan struct{}),
+		nil,
+	}
 	app.genesis()
 	return *app
 }
@@ -23,63 +45,240 @@ func (app *App) genesis() {
 	genesisBlock := Block{
 		-1,
 		prevHash,
+		padTarget(DIFFICULTY),
+		time.Now().UnixMilli(),
 		createSign(),
-		"genesis!",
+		nil,
+		uncleRoot(nil),
 		0,
+		0,
+		[]Transaction{newTransaction(PEER_ID, "genesis!", 0, 0, 0)},
+		nil,
 	}
+	genesisBlock.MerkleRoot = merkleRoot(genesisBlock.Transactions)
+	genesisBlock = signBlock(genesisBlock)
 	mutex.Lock()
 	app.Blocks = append(app.Blocks, genesisBlock)
+	app.Tree = newBlockTree(genesisBlock)
 	mutex.Unlock()
 }
 
 func (app *App) tryAddBlock(block Block) {
-	latestBlock := app.Blocks[len(app.Blocks)-1]
-	if isBlockValid(block, latestBlock) {
-		mutex.Lock()
-		app.Blocks = append(app.Blocks, block)
-		mutex.Unlock()
-	} else {
+	received := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	app.Times.receive(block, received)
+	app.addBlock(block)
+	app.Times.prune(app.Tree.orphans)
+}
+
+// addBlock puts block into the block tree, mutex must be held. A block
+// whose parent we don't know yet is kept as an orphan, otherwise the main
+// chain moves to the tip forkChoice picks.
+func (app *App) addBlock(block Block) {
+	if app.Tree.get(hashBlock(block)) != nil {
+		return
+	}
+	parent := app.Tree.get(block.PrevHash)
+	if parent == nil {
+		log.Printf("info: block with id: %d is an orphan, waiting for its parent", block.Round)
+		app.Tree.addOrphan(block)
+		return
+	}
+	if !isBlockValid(block, app.Tree.chainTo(parent)) {
 		log.Printf("error: could not add block - invalid")
+		return
+	}
+	node := app.Tree.insert(block, parent)
+	if tip := app.forkChoice(node); tip != app.Tree.tip {
+		chain := app.Tree.chainTo(tip)
+		if bad, err := app.Ledger.switchChain(app.Blocks, chain); err != nil {
+			log.Printf("error: could not add block - %s", err)
+			app.Tree.prune(app.Tree.get(hashBlock(bad)))
+			return
+		}
+		if reorg, isReorg := app.Tree.setTip(tip); isReorg {
+			app.Reorgs = append(app.Reorgs, reorg)
+		}
+		app.setMainChain(chain)
+	} else {
+		log.Printf("info: block with id: %d added to a side branch", block.Round)
+	}
+	app.Times.add(block)
+	for _, orphan := range app.Tree.takeOrphans(node) {
+		app.addBlock(orphan)
+	}
+}
+
+// forkChoice returns the tip the main chain should end in once node was
+// inserted. With GHOST it is the tip of the heaviest subtree, otherwise
+// node if its branch is heavier than the main chain.
+func (app *App) forkChoice(node *treeNode) *treeNode {
+	if GHOST {
+		return app.Tree.ghostTip()
+	}
+	if heavier(node, app.Tree.tip) {
+		return node
+	}
+	return app.Tree.tip
+}
+
+// syncChain merges a chain received from a peer into the block tree. A
+// chain built on another genesis shares no block with ours, then we
+// either keep ours or replace the whole tree by it.
+func (app *App) syncChain(remote []Block) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(remote) == 0 {
+		return
+	}
+	if bytes.Equal(hashBlock(remote[0]), hashBlock(app.Blocks[0])) {
+		for _, block := range remote[1:] {
+			app.addBlock(block)
+		}
+		return
+	}
+	chain := app.chooseChain(app.Blocks, remote)
+	if bytes.Equal(chainTipHash(chain), chainTipHash(app.Blocks)) {
+		return
+	}
+	if _, err := app.Ledger.switchChain(app.Blocks, chain); err != nil {
+		log.Printf("error: could not switch chain - %s", err)
+		return
+	}
+	if depth := len(app.Blocks) - 1; depth > 0 {
+		reorg := Reorg{
+			time.Now().UnixMilli(),
+			hex.EncodeToString(chainTipHash(app.Blocks)),
+			hex.EncodeToString(chainTipHash(chain)),
+			"",
+			depth,
+			len(chain) - 1,
+		}
+		log.Printf("warn: reorg! switched to a chain with another genesis, depth: %d", depth)
+		app.Reorgs = append(app.Reorgs, reorg)
+	}
+	app.Tree = newBlockTree(chain[0])
+	for _, block := range chain[1:] {
+		app.Tree.setTip(app.Tree.insert(block, app.Tree.tip))
+	}
+	app.setMainChain(chain)
+}
+
+// setMainChain makes chain the main chain, mutex must be held
+func (app *App) setMainChain(chain []Block) {
+	app.Mempool.update(app.Blocks, chain)
+	app.Blocks = chain
+	app.notifyTip()
+}
+
+// hashBlock returns the hash a block is identified and chained by, it
+// doesn't cover the signature so that the miner can sign after mining
+func hashBlock(block Block) []byte {
+	hash := sha256.Sum256(headerBytes(block))
+	return hash[:]
+}
+
+// chainTipHash returns the hash of the latest block of chain
+func chainTipHash(chain []Block) []byte {
+	return hashBlock(chain[len(chain)-1])
+}
+
+// notifyTip wakes everyone waiting on the current tip, mutex must be held
+func (app *App) notifyTip() {
+	close(app.tip)
+	app.tip = make(chan struct{})
+}
+
+// miningContext returns a child of parent that is cancelled as soon as the
+// tip changes, so that mining on top of a stale tip stops immediately
+func (app *App) miningContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	mutex.Lock()
+	tip := app.tip
+	mutex.Unlock()
+	go func() {
+		select {
+		case <-tip:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isTransactionsValid checks the transactions of block and that the
+// merkle root in its header commits to them
+func isTransactionsValid(block Block) bool {
+	if !bytes.Equal(block.MerkleRoot, merkleRoot(block.Transactions)) {
+		log.Printf("warn: block with id: %d has invalid merkle root", block.Round)
+		return false
+	}
+	for _, tx := range block.Transactions {
+		if !isTransactionValid(tx) {
+			log.Printf("warn: block with id: %d has invalid transaction", block.Round)
+			return false
+		}
 	}
+	return true
 }
 
-func isBlockValid(block Block, previousBlock Block) bool {
+// isBlockValid checks block against chain, the chain it is appended to
+func isBlockValid(block Block, chain []Block) bool {
+	previousBlock := chain[len(chain)-1]
 	if block.Round != previousBlock.Round+1 {
 		log.Printf("warn: block with id: %d is not the next block after the latest: %d",
 			block.Round, previousBlock.Round)
 		return false
 	}
-	j, _ := json.Marshal(previousBlock)
-	if hash := sha256.Sum256(j); !bytes.Equal(block.PrevHash, hash[:]) {
+	if !bytes.Equal(block.PrevHash, hashBlock(previousBlock)) {
 		log.Printf("warn: block with id: %d has invalid hash", block.Round)
 		return false
 	}
-	i, _ := json.Marshal(block)
-	if hash := sha256.Sum256(i); !(bytes.Compare(hash[:], DIFFICULTY) == -1) {
+	if !isTimestampValid(block, chain) {
+		return false
+	}
+	if target := nextTarget(chain); !bytes.Equal(block.Target, target) {
+		log.Printf("warn: block with id: %d has unexpected target", block.Round)
+		return false
+	}
+	if hash := powHash(block); !(bytes.Compare(hash[:], block.Target) == -1) {
 		log.Printf("warn: block with id: %d has invalid difficulty", block.Round)
 		return false
 	}
+	if !isSignValid(block) {
+		log.Printf("warn: block with id: %d has invalid signature", block.Round)
+		return false
+	}
+	if !isTransactionsValid(block) {
+		return false
+	}
+	if !isUnclesValid(block, chain) {
+		log.Printf("warn: block with id: %d has invalid uncles", block.Round)
+		return false
+	}
 	return true
 }
 
 func (app *App) isChainValid(chain *[]Block) bool {
 	for i := 1; i < len(*chain); i++ {
-		first := (*chain)[i-1]
-		second := (*chain)[i]
-		if !isBlockValid(second, first) {
+		if !isBlockValid((*chain)[i], (*chain)[:i]) {
 			return false
 		}
 	}
 	return true
 }
 
-// We always choose the longest valid chain
+// We always choose the valid chain with the most cumulative work. It is
+// only asked to pick between chains built on different geneses, branches
+// sharing ours are chosen by heavier. On a tie the remote chain wins, so
+// that a node that just started adopts the genesis of the one it joins.
 func (app *App) chooseChain(local []Block, remote []Block) []Block {
 	isLocalValid := app.isChainValid(&local)
 	isRemotevalid := app.isChainValid(&remote)
 
 	if isLocalValid && isRemotevalid {
-		if len(local) > len(remote) {
+		if chainWork(local).Cmp(chainWork(remote)) > 0 {
 			return local
 		} else {
 			return remote
@@ -0,0 +1,83 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// hashCount is the number of hashes mineBlock has tried so far
+var hashCount uint64
+
+// BenchResult is what a bench run reports
+type BenchResult struct {
+	Pow         string  `json:"pow"`
+	Blocks      int     `json:"blocks"` // mined by us
+	Hashes      uint64  `json:"hashes"`
+	Workers     int     `json:"workers"`
+	WallSeconds float64 `json:"wall_s"`
+	CPUSeconds  float64 `json:"cpu_s"` // user and system time of the whole process
+	HashRate    float64 `json:"hashes_per_s"`
+	CPUPerBlock float64 `json:"cpu_s_per_block"`
+	WallRatio   float64 `json:"cpu_wall_ratio"` // about the number of busy cores
+}
+
+// parseBenchLimit reads a bench limit, either a number of blocks or a
+// duration like "30s"
+func parseBenchLimit(arg string) (int, time.Duration, bool) {
+	if blocks, err := strconv.Atoi(arg); err == nil && blocks > 0 {
+		return blocks, 0, true
+	}
+	if duration, err := time.ParseDuration(arg); err == nil && duration > 0 {
+		return 0, duration, true
+	}
+	return 0, 0, false
+}
+
+// bench mines block after block until blocks are mined or duration has
+// passed, whichever limit is set
+func (app *App) bench(blocks int, duration time.Duration) BenchResult {
+	ctx := context.Background()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+	log.Printf("info: benchmarking...")
+	result := BenchResult{Pow: POW.Name(), Workers: WORKERS}
+	cpu, start, hashes := cpuTime(), time.Now(), atomic.LoadUint64(&hashCount)
+	for (blocks == 0 || result.Blocks < blocks) && ctx.Err() == nil {
+		if _, isMined := app.mineNext(ctx, ""); isMined {
+			result.Blocks++
+		}
+	}
+	wall := time.Since(start).Seconds()
+	result.Hashes = atomic.LoadUint64(&hashCount) - hashes
+	result.WallSeconds = wall
+	result.CPUSeconds = (cpuTime() - cpu).Seconds()
+	result.HashRate = float64(result.Hashes) / wall
+	if result.Blocks > 0 {
+		result.CPUPerBlock = result.CPUSeconds / float64(result.Blocks)
+	}
+	result.WallRatio = result.CPUSeconds / wall
+	return result
+}
+
+// logBenchResult writes result as one JSON line to the log and, unless it
+// is empty, to file
+func logBenchResult(result BenchResult, file string) {
+	j, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("warn: can jsonify bench result")
+		return
+	}
+	log.Printf("info: bench: %s", j)
+	if file != "" {
+		if err := AppendLine(file, string(j)); err != nil {
+			log.Printf("warn: can write %s", file)
+		}
+	}
+}
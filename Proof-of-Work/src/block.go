@@ -1,59 +1,223 @@
 package src
 
 import (
+	"context"
 	"crypto/sha256"
 	"crypto/ecdsa"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"log"
-	"bytes"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-// twenty-three "0"
+// twenty-three "0", the target of the genesis block
 var DIFFICULTY = []byte{0, 0, 2}
 
+var (
+	WORKERS        = runtime.NumCPU() // goroutines mineBlock splits the nonce space across
+	RESTART_MINING = true             // mine again on the new tip after an abort
+)
+
+// mining workers look for a cancellation every cancelCheck hashes
+const cancelCheck = 1 << 10
+
+// maxNonce is the last nonce tried before the extra nonce is rolled
+const maxNonce uint64 = math.MaxUint64
+
+// MiningStats is what mineBlock reports about one attempt
+type MiningStats struct {
+	Round      int    `json:"round"`
+	Hash       string `json:"hash"`
+	ExtraNonce uint64 `json:"extra_nonce"`
+	Nonce      uint64 `json:"nonce"`
+	Nonces     int    `json:"nonces"` // hashes tried by all workers together
+	Workers    int    `json:"workers"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
 type Block struct {
-	Round    int    `json:"round"`
-	PrevHash []byte `json:"previous_hash"`
-	Sign     Sign   `json:"signature"`
-	Data     string `json:"data"`
-	Nonce    int    `json:"nonce"`
+	Round        int           `json:"round"`
+	PrevHash     []byte        `json:"previous_hash"`
+	Target       []byte        `json:"target"`
+	Timestamp    int64         `json:"timestamp"` // unix milliseconds
+	Sign         Sign          `json:"signature"`
+	MerkleRoot   []byte        `json:"merkle_root"`
+	UncleRoot    []byte        `json:"uncle_root"`
+	ExtraNonce   uint64        `json:"extra_nonce"` // rolled whenever the nonces run out
+	Nonce        uint64        `json:"nonce"`
+	Transactions []Transaction `json:"transactions"`
+	Uncles       []Block       `json:"uncles"` // headers of stale blocks, see uncleRoot
 }
 
 type Sign struct {
 	PeerID peer.ID `json:"peer_id"`
+	PubKey []byte  `json:"public_key"` // the key PeerID is derived from
 	Sign   []byte  `json:"signature"`
 }
 
+// createSign names us as the miner, the signature itself is added by
+// signBlock once the nonce is found
 func createSign() Sign {
-	hash := sha256.Sum256([]byte(PEER_ID))
-	sign, _ := ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
-	return Sign{PEER_ID, sign}
+	pub, _ := crypto.MarshalPublicKey(pubKey)
+	return Sign{PEER_ID, pub, nil}
+}
+
+// blockProducer is who gets the coinbase of block
+func blockProducer(block Block) peer.ID {
+	return block.Sign.PeerID
 }
 
-func newBlock(round int, prevHash []byte, data string) Block {
-	return mineBlock(round, prevHash, data)
+func signBlock(block Block) Block {
+	hash := sha256.Sum256(headerBytes(block))
+	block.Sign.Sign, _ = ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
+	return block
 }
 
-func mineBlock(round int, prevHash []byte, data string) Block {
-	log.Printf("info: mining block...")
-	block := Block{round, prevHash, createSign(), data, 0}
+// isSignValid checks that the block is signed by the key its PeerID is
+// derived from
+func isSignValid(block Block) bool {
+	pub, err := crypto.UnmarshalPublicKey(block.Sign.PubKey)
+	if err != nil {
+		return false
+	}
+	if id, err := peer.IDFromPublicKey(pub); err != nil || id != block.Sign.PeerID {
+		return false
+	}
+	isValid, err := pub.Verify(headerBytes(block), block.Sign.Sign)
+	return err == nil && isValid
+}
 
-	for nonce := 0; ; nonce++ {
-		if nonce%1000000 == 0 {
-			log.Printf("info: nonce: %d", nonce)
-		}
-		block.Nonce = nonce
-		j, _ := json.Marshal(block)
-		if hash := sha256.Sum256(j); bytes.Compare(hash[:], DIFFICULTY) == -1 {
-			log.Printf(
-				"info: mined! nonce: %d, hash: %s",
-				nonce,
-				hex.EncodeToString(hash[:]))
-			return block
+// newBlock mines a block filled with the transactions of pool and
+// referencing uncles
+func newBlock(ctx context.Context, round int, prevHash []byte, target []byte, pool *Mempool, uncles []Block) (Block, MiningStats, bool) {
+	return mineBlock(ctx, round, prevHash, target, pool.pending(MAX_BLOCK_TXS), uncles)
+}
+
+// toTarget turns target into an array hashBelow can compare against
+func toTarget(target []byte) [sha256.Size]byte {
+	var t [sha256.Size]byte
+	copy(t[:], target)
+	return t
+}
+
+// hashBelow reports whether hash is below target, a word at a time
+func hashBelow(hash *[sha256.Size]byte, target *[sha256.Size]byte) bool {
+	for i := 0; i < sha256.Size; i += 8 {
+		h, t := binary.BigEndian.Uint64(hash[i:]), binary.BigEndian.Uint64(target[i:])
+		if h != t {
+			return h < t
 		}
 	}
+	return false
+}
+
+// mineBlock mines a block of txs and uncles on top of prevHash, see
+// mineTemplate
+func mineBlock(ctx context.Context, round int, prevHash []byte, target []byte, txs []Transaction, uncles []Block) (Block, MiningStats, bool) {
+	template := Block{
+		round,
+		prevHash,
+		target,
+		time.Now().UnixMilli(),
+		createSign(),
+		merkleRoot(txs),
+		uncleRoot(uncles),
+		0,
+		0,
+		txs,
+		uncles,
+	}
+	return mineTemplate(ctx, template, 0, maxNonce)
+}
+
+// mineTemplate searches the nonces first to last of template with WORKERS
+// goroutines, worker w trying first+w, first+w+WORKERS, ... up to last
+// until one of them finds a hash below the target. A worker that runs
+// out of nonces rolls the extra nonce and starts over from first+w. It
+// gives up as soon as ctx is cancelled and then reports false.
+func mineTemplate(ctx context.Context, template Block, first uint64, last uint64) (Block, MiningStats, bool) {
+	workers := WORKERS
+	if workers < 1 {
+		workers = 1
+	}
+	log.Printf("info: mining block with %d workers...", workers)
+	step := uint64(workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		found  = make(chan Block, 1)
+		once   sync.Once
+		wg     sync.WaitGroup
+		hashes = make([]int, workers)
+		goal   = toTarget(template.Target)
+	)
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			n := 0 // counted locally, workers writing next to each other in hashes is slow
+			defer func() { hashes[w] = n }()
+			if uint64(w) > last-first {
+				return // no nonce of ours to try
+			}
+			for block := template; ; block.ExtraNonce++ {
+				hasher := POW.NewHasher(headerBytes(block))
+				for nonce := first + uint64(w); nonce <= last; nonce += step {
+					if n%cancelCheck == 0 {
+						select {
+						case <-ctx.Done():
+							return
+						default:
+						}
+					}
+					n++
+					if hash := hasher.Hash(nonce); hashBelow(hash, &goal) {
+						block.Nonce = nonce
+						once.Do(func() {
+							log.Printf(
+								"info: mined! worker: %d, extra nonce: %d, nonce: %d, hash: %s",
+								w,
+								block.ExtraNonce,
+								nonce,
+								hex.EncodeToString(hash[:]))
+							found <- signBlock(block)
+							cancel()
+						})
+						return
+					}
+					if nonce+step < nonce {
+						break // the next nonce would wrap around
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	stats := MiningStats{Round: template.Round, Workers: workers, DurationMs: elapsed.Milliseconds()}
+	for w, n := range hashes {
+		log.Printf("info: worker %d: %d hashes, %.0f H/s", w, n, float64(n)/elapsed.Seconds())
+		stats.Nonces += n
+	}
+	atomic.AddUint64(&hashCount, uint64(stats.Nonces))
+	select {
+	case block := <-found:
+		stats.ExtraNonce, stats.Nonce = block.ExtraNonce, block.Nonce
+		stats.Hash = hex.EncodeToString(hashBlock(block))
+		return block, stats, true
+	default:
+		log.Printf("info: mining aborted")
+		return Block{}, stats, false
+	}
 }
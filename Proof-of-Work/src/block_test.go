@@ -0,0 +1,187 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+// benchTarget is met by one hash in 4096 on average
+var benchTarget = padTarget([]byte{0, 0x10})
+
+// TestExtraNonceRoll mines with a single nonce or two per extra nonce, so
+// that the workers run out of nonces and roll the extra nonce, and checks
+// the block found. With four workers, two start past the last nonce.
+func TestExtraNonceRoll(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	workers := WORKERS
+	defer func() { WORKERS = workers }()
+	target := padTarget([]byte{0, 0x01}) // one hash in 65536
+	goal := toTarget(target)
+	template := Block{
+		Round:      1,
+		PrevHash:   make([]byte, 32),
+		Target:     target,
+		Timestamp:  1700000000000,
+		Sign:       createSign(),
+		MerkleRoot: merkleRoot(nil),
+		UncleRoot:  uncleRoot(nil),
+	}
+	for _, c := range []struct {
+		workers int
+		last    uint64
+	}{{1, 0}, {4, 1}} {
+		WORKERS = c.workers
+		block, stats, isMined := mineTemplate(context.Background(), template, 0, c.last)
+		if !isMined {
+			t.Fatalf("%d workers, last nonce %d: nothing mined", c.workers, c.last)
+		}
+		if block.ExtraNonce == 0 || stats.ExtraNonce != block.ExtraNonce {
+			t.Errorf("%d workers, last nonce %d: extra nonce %d, stats %d",
+				c.workers, c.last, block.ExtraNonce, stats.ExtraNonce)
+		}
+		if block.Nonce > c.last {
+			t.Errorf("%d workers, last nonce %d: nonce %d", c.workers, c.last, block.Nonce)
+		}
+		if hash := powHash(block); !hashBelow(&hash, &goal) {
+			t.Errorf("%d workers, last nonce %d: hash above the target", c.workers, c.last)
+		}
+		if !isSignValid(block) {
+			t.Errorf("%d workers, last nonce %d: invalid signature", c.workers, c.last)
+		}
+		if want := int(block.ExtraNonce)*int(c.last+1) + int(block.Nonce) + 1; c.workers == 1 && stats.Nonces != want {
+			t.Errorf("1 worker, last nonce %d: %d hashes, want %d", c.last, stats.Nonces, want)
+		}
+	}
+}
+
+// meetsAll reports whether the hashes of block for the nonces first to
+// last are all below goal, or all above it if below is false
+func meetsAll(block Block, first uint64, last uint64, goal *[32]byte, below bool) bool {
+	hasher := POW.NewHasher(headerBytes(block))
+	for nonce := first; ; nonce++ {
+		if hashBelow(hasher.Hash(nonce), goal) != below {
+			return false
+		}
+		if nonce == last {
+			return true
+		}
+	}
+}
+
+// TestNonceWrap mines the last nonces below math.MaxUint64, where the
+// next nonce of every worker wraps around. The template is picked so that
+// none of the nonces meets the target with extra nonce 0 and all of them
+// do with extra nonce 1: the block must come with extra nonce 1, a worker
+// that wrapped around would find one below first with extra nonce 0.
+func TestNonceWrap(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	workers := WORKERS
+	defer func() { WORKERS = workers }()
+	target := padTarget([]byte{0x80}) // one hash in two
+	goal := toTarget(target)
+	for _, c := range []struct {
+		workers int
+		first   uint64
+	}{{2, math.MaxUint64 - 3}, {4, math.MaxUint64 - 2}} {
+		template := Block{
+			Round:      1,
+			PrevHash:   make([]byte, 32),
+			Target:     target,
+			Sign:       createSign(),
+			MerkleRoot: merkleRoot(nil),
+			UncleRoot:  uncleRoot(nil),
+		}
+		for template.Timestamp = 1700000000000; ; template.Timestamp++ {
+			rolled := template
+			rolled.ExtraNonce = 1
+			if meetsAll(template, c.first, math.MaxUint64, &goal, false) &&
+				meetsAll(rolled, c.first, math.MaxUint64, &goal, true) {
+				break
+			}
+		}
+		WORKERS = c.workers
+		block, stats, isMined := mineTemplate(context.Background(), template, c.first, math.MaxUint64)
+		if !isMined {
+			t.Fatalf("%d workers from %d: nothing mined", c.workers, c.first)
+		}
+		if block.ExtraNonce != 1 || stats.ExtraNonce != 1 {
+			t.Errorf("%d workers from %d: extra nonce %d, stats %d, want 1",
+				c.workers, c.first, block.ExtraNonce, stats.ExtraNonce)
+		}
+		if block.Nonce < c.first {
+			t.Errorf("%d workers from %d: nonce %d wrapped around", c.workers, c.first, block.Nonce)
+		}
+		if hash := powHash(block); !hashBelow(&hash, &goal) {
+			t.Errorf("%d workers from %d: hash above the target", c.workers, c.first)
+		}
+	}
+}
+
+// BenchmarkMineBlock mines blocks with a single worker and also reports
+// the time per hash tried
+func BenchmarkMineBlock(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	workers := WORKERS
+	WORKERS = 1
+	defer func() { WORKERS = workers }()
+	hashes := 0
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, stats, _ := mineBlock(context.Background(), i, make([]byte, 32), benchTarget, nil, nil)
+		hashes += stats.Nonces
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(hashes), "ns/hash")
+}
+
+func benchBlock() Block {
+	return Block{
+		Round:      1,
+		PrevHash:   make([]byte, 32),
+		Target:     benchTarget,
+		Timestamp:  1700000000000,
+		Sign:       createSign(),
+		MerkleRoot: merkleRoot(nil),
+		UncleRoot:  uncleRoot(nil),
+	}
+}
+
+// BenchmarkHeaderHash is the work of the mining loop per nonce, hashing
+// the header and comparing the hash against the target
+func BenchmarkHeaderHash(b *testing.B) {
+	block := benchBlock()
+	hasher := POW.NewHasher(headerBytes(block))
+	goal := toTarget(benchTarget)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for nonce := uint64(0); nonce < uint64(b.N); nonce++ {
+		hashBelow(hasher.Hash(nonce), &goal)
+	}
+}
+
+// BenchmarkHeaderHashJSON is the work per nonce of the mining loop before
+// the header was hashed by a Hasher: the whole block marshalled to JSON,
+// hashed and compared against the target, for comparison with
+// BenchmarkHeaderHash
+func BenchmarkHeaderHashJSON(b *testing.B) {
+	block := benchBlock()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for nonce := uint64(0); nonce < uint64(b.N); nonce++ {
+		block.Nonce = nonce
+		j, _ := json.Marshal(block)
+		hash := sha256.Sum256(j)
+		bytes.Compare(hash[:], benchTarget)
+	}
+}
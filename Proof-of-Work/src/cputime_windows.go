@@ -0,0 +1,22 @@
+package src
+
+import (
+	"log"
+	"syscall"
+	"time"
+)
+
+// cpuTime is the user and kernel CPU time the process has used so far
+func cpuTime() time.Duration {
+	var creation, exit, kernel, user syscall.Filetime
+	process, _ := syscall.GetCurrentProcess()
+	if err := syscall.GetProcessTimes(process, &creation, &exit, &kernel, &user); err != nil {
+		log.Printf("warn: can read process times")
+		return 0
+	}
+	// a Filetime counts 100ns ticks
+	ticks := func(t syscall.Filetime) int64 {
+		return int64(t.HighDateTime)<<32 | int64(t.LowDateTime)
+	}
+	return time.Duration((ticks(kernel) + ticks(user)) * 100)
+}
@@ -0,0 +1,84 @@
+package src
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"time"
+)
+
+var (
+	TARGET_BLOCK_TIME = 10 * time.Second // mean block interval we retarget to
+	RETARGET_INTERVAL = 10               // blocks between two retargets
+	// the easiest target a block may ever have (eight "0")
+	POW_LIMIT = padTarget([]byte{0, 0xff, 0xff, 0xff})
+)
+
+// maxAdjust bounds how far one retarget can move the target
+const maxAdjust = 4
+
+// padTarget turns a hash prefix such as DIFFICULTY into a full 256-bit target
+func padTarget(prefix []byte) []byte {
+	target := make([]byte, sha256.Size)
+	copy(target, prefix)
+	return target
+}
+
+// nextTarget returns the target the block following chain has to meet.
+// Every RETARGET_INTERVAL blocks the target is scaled by the ratio of the
+// observed to the expected timespan of the last interval, so that the mean
+// block time converges to TARGET_BLOCK_TIME. The genesis timestamp is the
+// node start time, so it is never part of the window.
+func nextTarget(chain []Block) []byte {
+	height := len(chain)
+	latest := chain[height-1]
+	if RETARGET_INTERVAL < 1 || height%RETARGET_INTERVAL != 0 {
+		return latest.Target
+	}
+	first := height - 1 - RETARGET_INTERVAL
+	if first < 1 {
+		first = 1
+	}
+	intervals := int64(height - 1 - first)
+	if intervals < 1 {
+		return latest.Target
+	}
+
+	expected := intervals * TARGET_BLOCK_TIME.Milliseconds()
+	actual := latest.Timestamp - chain[first].Timestamp
+	if actual < expected/maxAdjust {
+		actual = expected / maxAdjust
+	} else if actual > expected*maxAdjust {
+		actual = expected * maxAdjust
+	}
+
+	target := new(big.Int).SetBytes(latest.Target)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if limit := new(big.Int).SetBytes(POW_LIMIT); target.Cmp(limit) > 0 {
+		target = limit
+	}
+	return target.FillBytes(make([]byte, sha256.Size))
+}
+
+// blockWork is the expected number of hashes needed to meet target,
+// 2^256 / (target+1)
+func blockWork(target []byte) *big.Int {
+	denominator := new(big.Int).SetBytes(target)
+	denominator.Add(denominator, big.NewInt(1))
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, denominator)
+}
+
+// blockWeight is what a block adds to the fork-choice weight of its branch
+func blockWeight(block Block) *big.Int {
+	return blockWork(block.Target)
+}
+
+// chainWork sums up the work of every block in chain
+func chainWork(chain []Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range chain {
+		work.Add(work, blockWork(block.Target))
+	}
+	return work
+}
@@ -0,0 +1,71 @@
+package src
+
+import (
+	"encoding/binary"
+)
+
+// ENCODING_VERSION leads every encoding below and changes whenever their
+// layout does
+const ENCODING_VERSION = 3
+
+// Blocks and transactions are hashed and signed over a canonical binary
+// encoding, JSON is only used on the wire and for display. Integers are
+// big-endian, int fields are encoded as 64 bits, and byte strings (peer
+// ids, keys, hashes, payloads) are prefixed by their uint32 length:
+//
+//	header:      version u8 | round i64 | previous_hash bytes |
+//	             target bytes | timestamp i64 | peer_id bytes |
+//	             public_key bytes | merkle_root bytes |
+//	             uncle_root bytes | extra_nonce u64 | nonce u64
+//	transaction: version u8 | sender bytes | recipient bytes |
+//	             payload bytes | amount i64 | fee i64 | nonce i64 |
+//	             public_key bytes
+//
+// The nonce is the fixed-size tail of the header, so a miner can patch
+// it in place.
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendInt(buf []byte, v int) []byte {
+	return appendUint64(buf, uint64(int64(v)))
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	return append(append(buf, l[:]...), b...)
+}
+
+// headerBytes is what the block hash and the miner's signature cover,
+// that is everything but the signature, the transactions, which are
+// committed to by the merkle root, and the uncles, committed to by the
+// uncle root
+func headerBytes(block Block) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendInt(buf, block.Round)
+	buf = appendBytes(buf, block.PrevHash)
+	buf = appendBytes(buf, block.Target)
+	buf = appendUint64(buf, uint64(block.Timestamp))
+	buf = appendBytes(buf, []byte(block.Sign.PeerID))
+	buf = appendBytes(buf, block.Sign.PubKey)
+	buf = appendBytes(buf, block.MerkleRoot)
+	buf = appendBytes(buf, block.UncleRoot)
+	buf = appendUint64(buf, block.ExtraNonce)
+	return appendUint64(buf, block.Nonce)
+}
+
+// txBytes is what the sender's signature and the transaction hash cover
+func txBytes(tx Transaction) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendBytes(buf, []byte(tx.Sender))
+	buf = appendBytes(buf, []byte(tx.Recipient))
+	buf = appendBytes(buf, []byte(tx.Payload))
+	buf = appendInt(buf, tx.Amount)
+	buf = appendInt(buf, tx.Fee)
+	buf = appendInt(buf, tx.Nonce)
+	return appendBytes(buf, tx.PubKey)
+}
@@ -0,0 +1,84 @@
+package src
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// encodingVector pins the encoding of a fixed sample and its sha256, so
+// that other implementations can check theirs against it
+type encodingVector struct {
+	name     string
+	encoding []byte
+	want     string // hex of the encoding
+	hash     string // hex of its sha256
+}
+
+var vectorTx = Transaction{
+	"sender",
+	"recipient",
+	"hello",
+	10,
+	2,
+	1,
+	[]byte{0x01, 0x02, 0x03},
+	[]byte{0xff}, // not covered
+}
+
+var vectorBlock = Block{
+	1,
+	bytes.Repeat([]byte{0xaa}, 32),
+	padTarget([]byte{0x00, 0x00, 0x02}),
+	1700000000000,
+	Sign{"miner", []byte{0x04, 0x05}, []byte{0xff}}, // the signature isn't covered
+	bytes.Repeat([]byte{0xbb}, 32),
+	bytes.Repeat([]byte{0xcc}, 32),
+	7,
+	42,
+	nil,
+	nil,
+}
+
+func encodingVectors() []encodingVector {
+	return []encodingVector{
+		{"transaction", txBytes(vectorTx),
+			"03" +
+				"00000006" + "73656e646572" +
+				"00000009" + "726563697069656e74" +
+				"00000005" + "68656c6c6f" +
+				"000000000000000a" +
+				"0000000000000002" +
+				"0000000000000001" +
+				"00000003" + "010203",
+			"a684ea011eb584eaa4e3ca2c9bcb38d27b31b55c950217400a17cc1fbbe449b0"},
+		{"header", headerBytes(vectorBlock),
+			"03" +
+				"0000000000000001" +
+				"00000020" + "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+				"00000020" + "0000020000000000000000000000000000000000000000000000000000000000" +
+				"0000018bcfe56800" +
+				"00000005" + "6d696e6572" +
+				"00000002" + "0405" +
+				"00000020" + "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb" +
+				"00000020" + "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc" +
+				"0000000000000007" +
+				"000000000000002a",
+			"69701792ed6acf2388acc1452d702ab4f19240e5ff15a98bdef62dc45c06ca53"},
+	}
+}
+
+// TestEncodingVectors fails if the encodings above have drifted from the
+// pinned ones
+func TestEncodingVectors(t *testing.T) {
+	for _, v := range encodingVectors() {
+		hash := sha256.Sum256(v.encoding)
+		if got := hex.EncodeToString(v.encoding); got != v.want {
+			t.Errorf("%s encoding is %s, want %s", v.name, got, v.want)
+		}
+		if got := hex.EncodeToString(hash[:]); got != v.hash {
+			t.Errorf("%s hash is %s, want %s", v.name, got, v.hash)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var (
+	MINING_LOG    = ""              // file the mining stats of every block are appended to
+	DATA_TEMPLATE = "block {round}" // payload of a transaction put into every auto-mined block
+)
+
+// blockData fills the "{round}" placeholder of template
+func blockData(template string, round int) string {
+	return strings.ReplaceAll(template, "{round}", strconv.Itoa(round))
+}
+
+// mineNext mines one block on top of the current tip, publishes and adds
+// it. Unless template is empty, a transaction with the filled template is
+// put into the mempool first. When the tip changes it starts over on the
+// new tip if RESTART_MINING is set, otherwise it reports false. It also
+// gives up once ctx is done. A selfish miner mines on its private chain
+// instead and withholds the block.
+func (app *App) mineNext(ctx context.Context, template string) (Block, bool) {
+	if template != "" && !SELFISH_MINING {
+		mutex.Lock()
+		round := app.Blocks[len(app.Blocks)-1].Round + 1
+		mutex.Unlock()
+		app.submitTransaction(app.createTransaction(PEER_ID, blockData(template, round), 0, 0))
+	}
+	for {
+		tipCtx, cancel := app.miningContext(ctx)
+		mutex.Lock()
+		chain := app.Blocks
+		mutex.Unlock()
+		pool := app.Mempool
+		if SELFISH_MINING {
+			// the withheld blocks carry no transactions, see selfishMiner
+			chain, pool = app.selfish.chain(chain), newMempool(app.Ledger)
+		}
+		mutex.Lock()
+		uncles := app.pickUncles(chain)
+		mutex.Unlock()
+		latestBlock := chain[len(chain)-1]
+		block, stats, isMined := newBlock(
+			tipCtx,
+			latestBlock.Round+1,
+			chainTipHash(chain),
+			nextTarget(chain),
+			pool,
+			uncles)
+		cancel()
+		if isMined && SELFISH_MINING {
+			logMiningStats(stats)
+			app.release(app.selfish.mined(block))
+			app.logSelfish()
+			return block, true
+		}
+		if isMined {
+			logMiningStats(stats)
+			log.Printf("info: broadcast new block")
+			Publish(BlockRequest{block, block.Nonce, PEER_ID})
+			app.tryAddBlock(block)
+			return block, true
+		}
+		if ctx.Err() != nil {
+			return Block{}, false
+		}
+		if !RESTART_MINING {
+			log.Printf("info: the tip changed, block discarded")
+			return Block{}, false
+		}
+		log.Printf("info: the tip changed, restart mining on the new tip")
+	}
+}
+
+// logMiningStats writes stats as one JSON line to the log and MINING_LOG
+func logMiningStats(stats MiningStats) {
+	j, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("warn: can jsonify mining stats")
+		return
+	}
+	log.Printf("info: mining stats: %s", j)
+	if MINING_LOG != "" {
+		if err := AppendLine(MINING_LOG, string(j)); err != nil {
+			log.Printf("warn: can write %s", MINING_LOG)
+		}
+	}
+}
+
+// StartMining keeps mining block after block in the background until
+// StopMining is called
+func (app *App) StartMining(template string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if app.stopMining != nil {
+		log.Printf("error: already mining")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopMining = cancel
+	log.Printf("info: start mining with data: %s", template)
+	go func() {
+		for ctx.Err() == nil {
+			app.mineNext(ctx, template)
+		}
+		log.Printf("info: stopped mining")
+	}()
+}
+
+// MineOnce mines a single block in the background, StopMining aborts it
+func (app *App) MineOnce(template string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if app.stopMining != nil {
+		log.Printf("error: already mining")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopMining = cancel
+	go func() {
+		app.mineNext(ctx, template)
+		mutex.Lock()
+		// once stopped, stopMining may already belong to the next miner
+		if ctx.Err() == nil {
+			app.stopMining = nil
+		}
+		mutex.Unlock()
+		cancel()
+	}()
+}
+
+func (app *App) StopMining() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if app.stopMining == nil {
+		log.Printf("error: not mining")
+		return
+	}
+	app.stopMining()
+	app.stopMining = nil
+}
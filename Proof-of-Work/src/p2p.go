@@ -6,11 +6,14 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"log"
+	"math/big"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -29,6 +32,7 @@ var ( // immutable
 	KEYS = Keys{privKey, pubKey}
 	READWRITERS = []*bufio.ReadWriter{}
 	mutex = &sync.Mutex{}
+	rwMutex = &sync.Mutex{} // guards READWRITERS and writes to them
 )
 
 type ChainResponse struct {
@@ -37,6 +41,11 @@ type ChainResponse struct {
 	Receiver peer.ID `json:"receiver"`
 }
 
+type TransactionRequest struct {
+	Transaction Transaction `json:"transaction"`
+	FromPeerId  peer.ID     `json:"from_peer_id"`
+}
+
 type LocalChainRequest struct {
 	ToPeerId   peer.ID `json:"to_peer_id"`
 	FromPeerId peer.ID `json:"from_peer_id"`
@@ -44,7 +53,7 @@ type LocalChainRequest struct {
 
 type BlockRequest struct {
 	Block      Block   `json:"block"`
-	Nonce      int     `json:"nonce"`
+	Nonce      uint64  `json:"nonce"`
 	FromPeerId peer.ID `json:"from_peer_id"`
 }
 
@@ -52,11 +61,23 @@ func (keys Keys) PrivKey() crypto.PrivKey {
 	return keys.privKey
 }
 
+// AddReadWriter adds the stream of a new peer to the ones Publish writes to
+func AddReadWriter(rw *bufio.ReadWriter) {
+	rwMutex.Lock()
+	defer rwMutex.Unlock()
+	READWRITERS = append(READWRITERS, rw)
+}
+
+// Publish writes data to every peer. Blocks are published by the miner,
+// the REPL and the relaying goroutines at once, so a message is written
+// and flushed as a whole before the next.
 func Publish(data interface{}) {
 	j, err := json.Marshal(data)
 	if err != nil {
 		log.Printf("warn: can jsonify")
 	}
+	rwMutex.Lock()
+	defer rwMutex.Unlock()
 	for _, rw := range READWRITERS {
 		rw.Write(append(j, '\n'))
 		rw.Flush()
@@ -73,17 +94,23 @@ func (app *App) InjectEvent(rw *bufio.ReadWriter) {
 		var (
 			respChain     ChainResponse
 			respBlock     BlockRequest
+			respTx        TransactionRequest
 		)
 		if json.Unmarshal(msg, &respChain);
 				respChain.Receiver != "" && respChain.Receiver == PEER_ID {
 			log.Printf("info: Response from %s", respChain.Sender)
-			app.Blocks = app.chooseChain(
-				app.Blocks, respChain.Blocks)
+			app.syncChain(respChain.Blocks)
+		} else if json.Unmarshal(msg, &respTx);
+				respTx.Transaction.Sender != "" && respTx.FromPeerId != "" {
+			app.submitTransaction(respTx.Transaction)
 		} else if json.Unmarshal(msg, &respBlock);
 				respBlock.FromPeerId != "" &&
 				respBlock.Block.Nonce == respBlock.Nonce {
 			log.Printf("info: received new block from %s", respBlock.FromPeerId)
 			app.tryAddBlock(respBlock.Block)
+			if SELFISH_MINING {
+				app.onPublicBlock()
+			}
 		}
 	}
 }
@@ -113,19 +140,215 @@ func HandlePrintChains(app *App) {
 		log.Printf("warn: can indent json")
 	}
 	log.Printf("info: %s", out.String())
+
+	for i, block := range app.Blocks {
+		interval := "-"
+		if i > 0 {
+			interval = (time.Duration(block.Timestamp-app.Blocks[i-1].Timestamp) *
+				time.Millisecond).String()
+		}
+		log.Printf("info: round: %d, timestamp: %s, interval: %s",
+			block.Round,
+			time.UnixMilli(block.Timestamp).Format(time.RFC3339Nano),
+			interval)
+	}
+}
+
+func HandlePrintChainWork(app *App) {
+	log.Printf("info: Chain Work:")
+	mutex.Lock()
+	chain := app.Blocks
+	mutex.Unlock()
+	total := new(big.Int)
+	for _, block := range chain {
+		work := blockWork(block.Target)
+		total.Add(total, work)
+		log.Printf("info: round: %d, target: %s, work: %s, chainwork: %s",
+			block.Round,
+			hex.EncodeToString(block.Target),
+			work,
+			total)
+	}
+}
+
+func HandlePrintForks(app *App) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	log.Printf("info: Branches:")
+	for _, leaf := range app.Tree.leaves() {
+		log.Printf("info: tip: %s, round: %d, weight: %s, main: %t",
+			leaf.hash,
+			leaf.block.Round,
+			leaf.weight,
+			leaf == app.Tree.tip)
+	}
+	log.Printf("info: orphans: %d", len(app.Tree.orphans))
+	j, err := json.Marshal(app.Reorgs)
+	if err != nil {
+		log.Printf("warn: can jsonify reorgs")
+	}
+	log.Printf("info: reorgs: %s", j)
+}
+
+// submitTransaction adds tx to the mempool and passes it on to our peers
+// if we haven't seen it before
+func (app *App) submitTransaction(tx Transaction) {
+	if app.Mempool.add(tx) {
+		log.Printf("info: new transaction from %s, pending: %d", tx.Sender, app.Mempool.size())
+		Publish(TransactionRequest{tx, PEER_ID})
+	}
+}
+
+// createTransaction creates a transaction from us that follows the last
+// one we sent, including the ones still in the mempool
+func (app *App) createTransaction(recipient peer.ID, payload string, amount int, fee int) Transaction {
+	nonce := app.Ledger.account(PEER_ID).Nonce
+	for _, tx := range app.Mempool.all() {
+		if tx.Sender == PEER_ID && tx.Nonce > nonce {
+			nonce = tx.Nonce
+		}
+	}
+	return newTransaction(recipient, payload, amount, fee, nonce+1)
 }
 
+func HandleSendTransaction(cmd string, app *App) {
+	args := strings.SplitN(strings.TrimPrefix(cmd, "send tx "), " ", 4)
+	if len(args) < 3 {
+		log.Printf("error: usage: send tx <recipient> <amount> <fee> [payload]")
+		return
+	}
+	recipient, err := peer.Decode(args[0])
+	if err != nil {
+		log.Printf("error: invalid recipient")
+		return
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount < 0 {
+		log.Printf("error: invalid amount")
+		return
+	}
+	fee, err := strconv.Atoi(args[2])
+	if err != nil || fee < 0 {
+		log.Printf("error: invalid fee")
+		return
+	}
+	payload := ""
+	if len(args) == 4 {
+		payload = args[3]
+	}
+	app.submitTransaction(app.createTransaction(recipient, payload, amount, fee))
+}
+
+func HandleBalance(cmd string, app *App) {
+	id := PEER_ID
+	if arg := strings.TrimPrefix(strings.TrimPrefix(cmd, "balance"), " "); arg != "" {
+		var err error
+		if id, err = peer.Decode(arg); err != nil {
+			log.Printf("error: invalid peer id")
+			return
+		}
+	}
+	account := app.Ledger.account(id)
+	log.Printf("info: %s balance: %d, nonce: %d", id, account.Balance, account.Nonce)
+}
+
+func HandlePrintMempool(app *App) {
+	log.Printf("info: Mempool:")
+	j, err := json.Marshal(app.Mempool.all())
+	if err != nil {
+		log.Printf("warn: can jsonify transactions")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, j, "", "  "); err != nil {
+		log.Printf("warn: can indent json")
+	}
+	log.Printf("info: %s", out.String())
+}
+
+// HandleCreateBlock mines one block filled from the mempool in the
+// background, the data of "create b <data>" is put into the mempool first.
+// The REPL stays usable meanwhile and "mine stop" can abort it.
 func HandleCreateBlock(cmd string, app *App) {
-	data := strings.TrimPrefix(cmd, "create b ")
-	if data == "" {
-		log.Printf("error: invalid command")
+	data := strings.TrimPrefix(strings.TrimPrefix(cmd, "create b"), " ")
+	app.MineOnce(data)
+}
+
+func HandleMine(cmd string, app *App) {
+	if cmd == "mine stop" {
+		app.StopMining()
+	} else if template := strings.TrimPrefix(cmd, "mine start"); template == "" {
+		app.StartMining(DATA_TEMPLATE)
+	} else if strings.HasPrefix(template, " ") {
+		app.StartMining(strings.TrimPrefix(template, " "))
 	} else {
-		latestBlock := app.Blocks[len(app.Blocks)-1]
-		j, _ := json.Marshal(latestBlock)
-		hash := sha256.Sum256(j)
-		block := newBlock(latestBlock.Round+1, hash[:], data)
-		log.Printf("info: broadcast new block")
-		Publish(BlockRequest{block, block.Nonce, PEER_ID})
-		app.tryAddBlock(block)
+		log.Printf("error: invalid command")
+	}
+}
+
+// HandleBench runs "bench <blocks|duration> [file]", the result is logged
+// as JSON and appended to file if given
+func HandleBench(cmd string, app *App) {
+	args := strings.Fields(strings.TrimPrefix(cmd, "bench"))
+	if len(args) < 1 || len(args) > 2 {
+		log.Printf("error: usage: bench <blocks|duration> [file]")
+		return
+	}
+	blocks, duration, isValid := parseBenchLimit(args[0])
+	if !isValid {
+		log.Printf("error: invalid number of blocks or duration")
+		return
+	}
+	file := ""
+	if len(args) == 2 {
+		file = args[1]
+	}
+	logBenchResult(app.bench(blocks, duration), file)
+}
+
+// HandlePrintTimes prints the summary of the intervals between added
+// blocks
+func HandlePrintTimes(app *App) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	j, err := json.Marshal(app.Times.stats())
+	if err != nil {
+		log.Printf("warn: can jsonify block times")
+	}
+	log.Printf("info: block times: %s", j)
+}
+
+// HandleExportTimes writes the block times for "export times <file>" as
+// CSV if file ends in .csv, as JSON lines otherwise
+func HandleExportTimes(cmd string, app *App) {
+	filename := strings.TrimSpace(strings.TrimPrefix(cmd, "export times"))
+	if filename == "" {
+		log.Printf("error: usage: export times <file>")
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := app.Times.export(filename); err != nil {
+		log.Printf("error: can write %s", filename)
+		return
+	}
+	j, _ := json.Marshal(app.Times.stats())
+	log.Printf("info: exported block times to %s: %s", filename, j)
+}
+
+// HandleStatus prints the status of the block "status <hash|round>" names
+func HandleStatus(cmd string, app *App) {
+	query := strings.TrimSpace(strings.TrimPrefix(cmd, "status"))
+	mutex.Lock()
+	status, isKnown := app.blockStatus(query)
+	mutex.Unlock()
+	if !isKnown {
+		log.Printf("error: unknown block %s", query)
+		return
+	}
+	j, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("warn: can jsonify block status")
 	}
+	log.Printf("info: status: %s", j)
 }
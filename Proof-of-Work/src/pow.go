@@ -0,0 +1,140 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"hash"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PowFunction is the hash the header of a block has to bring below its
+// target. It is part of the chain configuration, all nodes of a chain
+// have to use the same one.
+type PowFunction interface {
+	Name() string
+	// NewHasher prepares to hash header, which ends with the nonce, for
+	// one nonce after another. The hasher takes header over.
+	NewHasher(header []byte) PowHasher
+}
+
+// PowHasher hashes a header with nonce, the hash is overwritten by the
+// next call
+type PowHasher interface {
+	Hash(nonce uint64) *[sha256.Size]byte
+}
+
+var POW_FUNCTIONS = map[string]PowFunction{
+	"sha256":   sha256Pow{false},
+	"sha256d":  sha256Pow{true},
+	"scrypt":   scryptPow{1024, 1, 1},     // the parameters of Litecoin
+	"argon2id": argon2Pow{1, 4 * 1024, 1}, // one pass over 4 MiB
+}
+
+var POW = POW_FUNCTIONS["sha256"]
+
+// powHash returns the hash of block under POW
+func powHash(block Block) [sha256.Size]byte {
+	return *POW.NewHasher(headerBytes(block)).Hash(block.Nonce)
+}
+
+// sha256Pow hashes the header with sha256, twice if double like Bitcoin
+type sha256Pow struct {
+	double bool
+}
+
+func (pow sha256Pow) Name() string {
+	if pow.double {
+		return "sha256d"
+	}
+	return "sha256"
+}
+
+// NewHasher computes the sha256 state after the part of the header that
+// doesn't change once. It is restored for every nonce, so only the tail
+// of the header ending with the nonce is hashed again, without any
+// allocation.
+func (pow sha256Pow) NewHasher(header []byte) PowHasher {
+	split := (len(header) - 8) / sha256.BlockSize * sha256.BlockSize
+	digest := sha256.New()
+	digest.Write(header[:split])
+	prefix, _ := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	return &sha256Hasher{
+		double: pow.double,
+		digest: digest,
+		state:  digest.(encoding.BinaryUnmarshaler),
+		prefix: prefix,
+		tail:   header[split:],
+	}
+}
+
+type sha256Hasher struct {
+	double bool
+	digest hash.Hash
+	state  encoding.BinaryUnmarshaler // digest itself
+	prefix []byte                     // marshalled state after the fixed part
+	tail   []byte
+	sum    [sha256.Size]byte
+}
+
+func (h *sha256Hasher) Hash(nonce uint64) *[sha256.Size]byte {
+	binary.BigEndian.PutUint64(h.tail[len(h.tail)-8:], nonce)
+	h.state.UnmarshalBinary(h.prefix)
+	h.digest.Write(h.tail)
+	h.digest.Sum(h.sum[:0])
+	if h.double {
+		h.sum = sha256.Sum256(h.sum[:])
+	}
+	return &h.sum
+}
+
+// scryptPow hashes the header with scrypt, salted with the header itself
+type scryptPow struct {
+	n, r, p int
+}
+
+func (pow scryptPow) Name() string {
+	return "scrypt"
+}
+
+func (pow scryptPow) NewHasher(header []byte) PowHasher {
+	return &keyHasher{header: header, key: func(header []byte) []byte {
+		key, _ := scrypt.Key(header, header, pow.n, pow.r, pow.p, sha256.Size)
+		return key
+	}}
+}
+
+// argon2Pow hashes the header with Argon2id, salted with the header
+// itself
+type argon2Pow struct {
+	time    uint32
+	memory  uint32 // KiB
+	threads uint8
+}
+
+func (pow argon2Pow) Name() string {
+	return "argon2id"
+}
+
+func (pow argon2Pow) NewHasher(header []byte) PowHasher {
+	return &keyHasher{header: header, key: func(header []byte) []byte {
+		return argon2.IDKey(header, header, pow.time, pow.memory, pow.threads, sha256.Size)
+	}}
+}
+
+// keyHasher hashes the whole header for every nonce with a key
+// derivation function, being memory-hard they gain nothing from a
+// precomputed prefix
+type keyHasher struct {
+	header []byte
+	key    func(header []byte) []byte
+	sum    [sha256.Size]byte
+}
+
+func (h *keyHasher) Hash(nonce uint64) *[sha256.Size]byte {
+	binary.BigEndian.PutUint64(h.header[len(h.header)-8:], nonce)
+	copy(h.sum[:], h.key(h.header))
+	return &h.sum
+}
@@ -0,0 +1,141 @@
+package src
+
+import (
+	"bytes"
+	"log"
+	"sync"
+)
+
+var SELFISH_MINING = false // withhold mined blocks, see selfishMiner
+
+// selfishMiner follows the selfish mining strategy of Eyal and Sirer. It
+// mines on a private chain and withholds its blocks, releasing them only
+// when honest blocks come in: to race the public chain when it catches
+// up, to override it when it is one block behind, and otherwise just
+// enough to match its length. Chains are compared by length as in the
+// paper, and the withheld blocks carry no transactions, which could
+// conflict with the ones honest miners include meanwhile.
+type selfishMiner struct {
+	mutex    sync.Mutex
+	private  []Block // genesis to the private tip, published or not
+	withheld int     // blocks at the end of private not published yet
+	public   int     // length of the public chain last seen
+	race     bool    // a released branch races a public one of the same length
+}
+
+// adopt gives up the private chain for public when it is behind or
+// doesn't even share its genesis
+func (s *selfishMiner) adopt(public []Block) {
+	if len(s.private) >= len(public) &&
+		bytes.Equal(hashBlock(s.private[0]), hashBlock(public[0])) {
+		return
+	}
+	if s.withheld > 0 {
+		log.Printf("info: selfish: lost %d withheld blocks", s.withheld)
+	}
+	s.private = append([]Block{}, public...)
+	s.withheld, s.race = 0, false
+}
+
+// chain returns the chain to mine on given the public one
+func (s *selfishMiner) chain(public []Block) []Block {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.private == nil {
+		s.private, s.public = append([]Block{}, public...), len(public)
+	}
+	s.adopt(public)
+	return append([]Block{}, s.private...)
+}
+
+// mined appends block to the private chain and returns what to release
+func (s *selfishMiner) mined(block Block) []Block {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.private = append(s.private, block)
+	if s.race {
+		// our branch is ahead now and wins the race
+		s.race = false
+		return []Block{block}
+	}
+	s.withheld++
+	return nil
+}
+
+// published returns the blocks to release once the public chain changed
+func (s *selfishMiner) published(public []Block) []Block {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.private == nil || len(public) <= s.public {
+		s.public = len(public)
+		return nil
+	}
+	s.public = len(public)
+	s.adopt(public)
+	lead := len(s.private) - len(public)
+	release := 0
+	switch {
+	case s.withheld == 0:
+	case lead == 0:
+		// the honest miners caught up, race them
+		release, s.race = s.withheld, true
+	case lead == 1:
+		// override the public chain while we still can
+		release = s.withheld
+	default:
+		// match the length of the public chain and keep the rest
+		release = len(public) - (len(s.private) - s.withheld)
+	}
+	if release <= 0 {
+		return nil
+	}
+	first := len(s.private) - s.withheld
+	s.withheld -= release
+	return append([]Block{}, s.private[first:first+release]...)
+}
+
+// lead is how many blocks the private chain is ahead of the public one
+func (s *selfishMiner) lead(public []Block) (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.private) - len(public), s.withheld
+}
+
+// release publishes blocks of the private chain and adds them
+func (app *App) release(blocks []Block) {
+	for _, block := range blocks {
+		log.Printf("info: selfish: releasing block with id: %d", block.Round)
+		Publish(BlockRequest{block, block.Nonce, PEER_ID})
+		app.tryAddBlock(block)
+	}
+}
+
+// onPublicBlock lets the selfish miner react to a block from a peer
+func (app *App) onPublicBlock() {
+	mutex.Lock()
+	public := app.Blocks
+	mutex.Unlock()
+	app.release(app.selfish.published(public))
+	app.logSelfish()
+}
+
+// logSelfish logs the private lead and the share of the main chain, and
+// so of the block rewards, we got
+func (app *App) logSelfish() {
+	mutex.Lock()
+	public := app.Blocks
+	mutex.Unlock()
+	ours := 0
+	for _, block := range public[1:] {
+		if blockProducer(block) == PEER_ID {
+			ours++
+		}
+	}
+	share := 0.0
+	if len(public) > 1 {
+		share = float64(ours) / float64(len(public)-1)
+	}
+	lead, withheld := app.selfish.lead(public)
+	log.Printf("info: selfish: private lead: %d, withheld: %d, revenue share: %d/%d (%.3f)",
+		lead, withheld, ours, len(public)-1, share)
+}
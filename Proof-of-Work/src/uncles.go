@@ -0,0 +1,150 @@
+package src
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	MAX_UNCLES      = 2  // uncles a block may reference at most
+	MAX_UNCLE_DEPTH = 6  // rounds an uncle may lie behind the block referencing it
+	NEPHEW_SHARE    = 32 // a block gets BLOCK_REWARD/NEPHEW_SHARE for every uncle
+)
+
+// An uncle is a stale block whose parent is on the chain but which
+// itself isn't, referenced by a later block so that its work and its
+// producer aren't lost. It is kept as a bare header, without its
+// transactions and uncles.
+
+// uncleHeader strips block down to what is kept of it as an uncle
+func uncleHeader(block Block) Block {
+	block.Transactions, block.Uncles = nil, nil
+	return block
+}
+
+// uncleRoot is what the header of a block commits its uncles with, the
+// hash of their hashes. No uncles give zero bytes, like an empty merkle
+// root.
+func uncleRoot(uncles []Block) []byte {
+	if len(uncles) == 0 {
+		return make([]byte, sha256.Size)
+	}
+	var hashes []byte
+	for _, uncle := range uncles {
+		hashes = append(hashes, hashBlock(uncle)...)
+	}
+	hash := sha256.Sum256(hashes)
+	return hash[:]
+}
+
+// uncleReward is what the producer of an uncle depth rounds behind the
+// block referencing it gets, less the deeper it is
+func uncleReward(depth int) int {
+	return BLOCK_REWARD * (MAX_UNCLE_DEPTH + 2 - depth) / (MAX_UNCLE_DEPTH + 2)
+}
+
+// blockRewards returns the coins block creates: the block reward and a
+// share for every uncle for its producer, and an uncle reward for the
+// producer of each uncle. The genesis block creates no coins.
+func blockRewards(block Block) map[peer.ID]int {
+	if block.Round < 0 {
+		return map[peer.ID]int{}
+	}
+	rewards := map[peer.ID]int{blockProducer(block): BLOCK_REWARD}
+	for _, uncle := range block.Uncles {
+		rewards[blockProducer(block)] += BLOCK_REWARD / NEPHEW_SHARE
+		rewards[blockProducer(uncle)] += uncleReward(block.Round - uncle.Round)
+	}
+	return rewards
+}
+
+// includedUncles returns the hashes of the uncles referenced by the last
+// blocks of chain, those whose uncles could still be referenced again
+func includedUncles(chain []Block) map[string]bool {
+	included := map[string]bool{}
+	for i := len(chain) - 1; i >= 0 && i >= len(chain)-MAX_UNCLE_DEPTH; i-- {
+		for _, uncle := range chain[i].Uncles {
+			included[hex.EncodeToString(hashBlock(uncle))] = true
+		}
+	}
+	return included
+}
+
+// isUncleValid checks that uncle can be referenced by the block following
+// chain: it lies at most MAX_UNCLE_DEPTH rounds behind, branches off the
+// chain, and is a valid block there
+func isUncleValid(uncle Block, chain []Block) bool {
+	round := chain[len(chain)-1].Round + 1
+	if depth := round - uncle.Round; depth < 1 || depth > MAX_UNCLE_DEPTH || uncle.Round < 0 {
+		return false
+	}
+	// the block of round r is chain[r-genesis round], the genesis round
+	// being -1 on our chains but whatever a peer sent on its own
+	i := uncle.Round - chain[0].Round
+	if i < 1 || i >= len(chain) {
+		return false
+	}
+	parent, sibling := chain[i-1], chain[i]
+	if !bytes.Equal(uncle.PrevHash, hashBlock(parent)) || bytes.Equal(hashBlock(uncle), hashBlock(sibling)) {
+		return false
+	}
+	if len(uncle.Transactions) > 0 || len(uncle.Uncles) > 0 {
+		return false
+	}
+	prefix := chain[:i]
+	if !isTimestampValid(uncle, prefix) || !bytes.Equal(uncle.Target, nextTarget(prefix)) {
+		return false
+	}
+	hash := powHash(uncle)
+	return bytes.Compare(hash[:], uncle.Target) == -1 && isSignValid(uncle)
+}
+
+// isUnclesValid checks the uncles of block against chain, the chain it is
+// appended to. Every uncle must be valid and referenced only once.
+func isUnclesValid(block Block, chain []Block) bool {
+	if len(block.Uncles) > MAX_UNCLES || !bytes.Equal(block.UncleRoot, uncleRoot(block.Uncles)) {
+		return false
+	}
+	included := includedUncles(chain)
+	for _, uncle := range block.Uncles {
+		hash := hex.EncodeToString(hashBlock(uncle))
+		if included[hash] || !isUncleValid(uncle, chain) {
+			return false
+		}
+		included[hash] = true
+	}
+	return true
+}
+
+// pickUncles returns the stale blocks of the tree the block following
+// chain can reference, the most recent first. mutex must be held.
+func (app *App) pickUncles(chain []Block) []Block {
+	included := includedUncles(chain)
+	uncles := []Block{}
+	for _, node := range app.Tree.nodes {
+		if included[node.hash] || node.block.Round < 0 {
+			continue
+		}
+		if uncle := uncleHeader(node.block); isUncleValid(uncle, chain) {
+			uncles = append(uncles, uncle)
+		}
+	}
+	sort.Slice(uncles, func(i, j int) bool {
+		if uncles[i].Round != uncles[j].Round {
+			return uncles[i].Round > uncles[j].Round
+		}
+		return bytes.Compare(hashBlock(uncles[i]), hashBlock(uncles[j])) < 0
+	})
+	if len(uncles) > MAX_UNCLES {
+		uncles = uncles[:MAX_UNCLES]
+	}
+	if len(uncles) > 0 {
+		log.Printf("info: referencing %d uncles", len(uncles))
+	}
+	return uncles
+}
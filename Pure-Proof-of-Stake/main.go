@@ -5,10 +5,10 @@ import (
 
 	"bufio"
 	"context"
+	"flag"
 	"log"
 	"os"
 	"strings"
-	"sync"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -21,11 +21,42 @@ import (
 )
 
 var (
-	app = src.NewApp()
-	mutex = &sync.Mutex{}
+	app src.App // created once the flags are parsed
 )
 
 func main() {
+	maxBlockTxs := flag.Int("max-block-txs", src.MAX_BLOCK_TXS,
+		"transactions a new block takes from the mempool at most")
+	proposers := flag.Int("proposers", src.PROPOSERS,
+		"proposers sortition selects per round on average")
+	committee := flag.Int("committee", src.COMMITTEE,
+		"votes sortition selects per step on average")
+	genesis := flag.String("genesis", "",
+		"JSON file with the coins of every peer id at genesis, otherwise we get -genesis-stake")
+	genesisStake := flag.Int("genesis-stake", src.GENESIS_STAKE,
+		"coins we get at genesis without -genesis")
+	partRounds := flag.Int("participation-rounds", src.PARTICIPATION_ROUNDS,
+		"rounds a registered set of participation keys covers")
+	keyFile := flag.String("key", "",
+		"PEM file with the key of the node, created if missing, to keep the peer id across runs")
+	flag.Parse()
+	src.MAX_BLOCK_TXS = *maxBlockTxs
+	src.PROPOSERS, src.COMMITTEE = *proposers, *committee
+	src.GENESIS_STAKE, src.PARTICIPATION_ROUNDS = *genesisStake, *partRounds
+	if *keyFile != "" {
+		if err := src.LoadKey(*keyFile); err != nil {
+			log.Fatalf("error: can load key: %s", err)
+		}
+	}
+	if *genesis != "" {
+		allocation, err := src.ReadAllocation(*genesis)
+		if err != nil {
+			log.Fatalf("error: can read genesis allocation: %s", err)
+		}
+		src.GENESIS_ALLOCATION = allocation
+	}
+	app = src.NewApp()
+
 	go func ()  {
 		log.Print(http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -54,12 +85,12 @@ func main() {
 	addrs, _ := peer.AddrInfoToP2pAddrs(&peerInfo)
 	log.Printf("node address: %s", addrs[0])
 
-	if len(os.Args) > 1 {
+	if flag.NArg() > 0 {
 		log.Printf("info: sending init event")
 		var addr ma.Multiaddr
 		var pi *peer.AddrInfo
-		for i := 1; i < len(os.Args); i++ {
-			addr, _ = ma.NewMultiaddr(os.Args[i])
+		for _, arg := range flag.Args() {
+			addr, _ = ma.NewMultiaddr(arg)
 			pi, _ = peer.AddrInfoFromP2pAddr(addr)
 			if err := host.Connect(context.Background(), *pi); err != nil {
 				log.Printf("error: can connect")
@@ -72,9 +103,7 @@ func main() {
 			} else {
 				rw := bufio.NewReadWriter(
 					bufio.NewReader(s), bufio.NewWriter(s))
-				mutex.Lock()
-				src.READWRITERS = append(src.READWRITERS, rw)
-				mutex.Unlock()
+				src.AddReadWriter(rw)
 
 				go app.InjectEvent(rw)
 			}
@@ -92,8 +121,28 @@ func main() {
 			src.HandlePrintPeers(host)
 		} else if cmd == "ls c" {
 			src.HandlePrintChains(&app)
-		} else if strings.HasPrefix(cmd, "create b ") {
+		} else if cmd == "ls f" {
+			src.HandlePrintForks(&app)
+		} else if cmd == "ls tx" {
+			src.HandlePrintMempool(&app)
+		} else if cmd == "balance" || strings.HasPrefix(cmd, "balance ") {
+			src.HandleBalance(cmd, &app)
+		} else if strings.HasPrefix(cmd, "send tx ") {
+			src.HandleSendTransaction(cmd, &app)
+		} else if cmd == "create b" || strings.HasPrefix(cmd, "create b ") {
 			src.HandleCreateBlock(cmd, &app)
+		} else if strings.HasPrefix(cmd, "bench ") {
+			src.HandleBench(cmd, &app)
+		} else if strings.HasPrefix(cmd, "status ") {
+			src.HandleStatus(cmd, &app)
+		} else if cmd == "ls messages" || strings.HasPrefix(cmd, "ls messages ") {
+			src.HandlePrintMessages(cmd)
+		} else if cmd == "ls dropped" {
+			src.HandlePrintDropped()
+		} else if cmd == "ls times" {
+			src.HandlePrintTimes(&app)
+		} else if strings.HasPrefix(cmd, "export times ") {
+			src.HandleExportTimes(cmd, &app)
 		} else {
 			log.Printf("error: unknown command")
 		}
@@ -104,9 +153,7 @@ func handleStream(s network.Stream) {
 	log.Printf("info: get new Stream %s", s.ID())
 	rw := bufio.NewReadWriter(
 		bufio.NewReader(s), bufio.NewWriter(s))
-	mutex.Lock()
-	src.READWRITERS = append(src.READWRITERS, rw)
-	mutex.Unlock()
+	src.AddReadWriter(rw)
 	log.Printf("info: sending local chain to %s", s.Conn().RemotePeer())
 	src.Publish(src.ChainResponse{
 		Blocks: app.Blocks,
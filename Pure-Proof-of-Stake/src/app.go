@@ -4,17 +4,32 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"log"
+	"math/big"
+	"time"
 )
 
 type App struct {
-	Blocks []Block `json:"blocks"`
-	Seed   string  `json:"seed"`
+	Blocks  []Block    `json:"blocks"` // the main chain, genesis to tip
+	Seed    string     `json:"seed"`
+	Tree    *BlockTree `json:"-"`
+	Reorgs  []Reorg    `json:"reorgs"`
+	Ledger  *Ledger    `json:"-"`
+	Mempool *Mempool   `json:"-"`
+	Times   *AddTimes  `json:"-"`
 }
 
 func NewApp() App {
-	app := &App{make([]Block, 0), "genesis!"}
+	ledger := newLedger()
+	app := &App{
+		make([]Block, 0),
+		"genesis!",
+		nil,
+		[]Reorg{},
+		ledger,
+		newMempool(ledger),
+		newAddTimes(),
+	}
 	app.genesis()
 	return *app
 }
@@ -24,54 +39,208 @@ func (app *App) genesis() {
 	genesisBlock := Block{
 		-1,
 		prevHash,
+		time.Now().UnixMilli(),
 		createSSeed("genesis!"),
-		"genesis!",
+		Credential{},
+		nil,
+		nil,
+		append(genesisTransactions(), genesisRegistration()),
 	}
+	genesisBlock.MerkleRoot = merkleRoot(genesisBlock.Transactions)
 	mutex.Lock()
 	app.Blocks = append(app.Blocks, genesisBlock)
+	app.Tree = newBlockTree(genesisBlock)
+	app.Ledger.switchChain(nil, app.Blocks)
 	mutex.Unlock()
 }
 
+// seedAfter returns the seed of the round following block
+func seedAfter(block Block) string {
+	if block.Round < 0 {
+		return "genesis!"
+	}
+	hash := sha256.Sum256(sseedBytes(block.SSeed, block.Round))
+	return hex.EncodeToString(hash[:])
+}
+
+// every block counts the same, i.e. we follow the longest chain
+func blockWeight(block Block) *big.Int {
+	return big.NewInt(1)
+}
+
 func (app *App) tryAddBlock(block Block) {
-	latestBlock := app.Blocks[len(app.Blocks)-1]
-	if isBlockValid(block, latestBlock) {
-		j, _ := json.Marshal([]interface{} {block.SSeed, block.Round})
-		hash := sha256.Sum256(j)
-		app.Seed = hex.EncodeToString(hash[:])
-		mutex.Lock()
-		app.Blocks = append(app.Blocks, block)
-		mutex.Unlock()
-	} else {
+	received := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	app.Times.receive(block, received)
+	app.addBlock(block)
+	app.Times.prune(app.Tree.orphans)
+}
+
+// setMainChain makes chain the main chain, mutex must be held
+func (app *App) setMainChain(chain []Block) {
+	app.Mempool.update(app.Blocks, chain)
+	app.Blocks = chain
+	app.Seed = seedAfter(chain[len(chain)-1])
+	MESSAGE_STORE.gc(app.finalizedHeight(), len(chain)-1)
+	go app.admitParked()
+}
+
+// addBlock puts block into the block tree, mutex must be held. A block
+// whose parent we don't know yet is kept as an orphan, a block on a
+// branch longer than the main chain makes that branch the main chain.
+func (app *App) addBlock(block Block) {
+	if app.Tree.get(hashBlock(block)) != nil {
+		return
+	}
+	parent := app.Tree.get(block.PrevHash)
+	if parent == nil {
+		log.Printf("info: block with id: %d is an orphan, waiting for its parent", block.Round)
+		app.Tree.addOrphan(block)
+		return
+	}
+	if !isBlockValid(block, app.Tree.chainTo(parent), parent.stake) {
 		log.Printf("error: could not add block - invalid")
+		return
+	}
+	node := app.Tree.insert(block, parent)
+	if heavier(node, app.Tree.tip) {
+		chain := app.Tree.chainTo(node)
+		if bad, err := app.Ledger.switchChain(app.Blocks, chain); err != nil {
+			log.Printf("error: could not add block - %s", err)
+			app.Tree.prune(app.Tree.get(hashBlock(bad)))
+			return
+		}
+		if reorg, isReorg := app.Tree.setTip(node); isReorg {
+			app.Reorgs = append(app.Reorgs, reorg)
+		}
+		app.setMainChain(chain)
+	} else {
+		log.Printf("info: block with id: %d added to a side branch", block.Round)
+	}
+	app.Times.add(block)
+	for _, orphan := range app.Tree.takeOrphans(node) {
+		app.addBlock(orphan)
 	}
 }
 
-func isBlockValid(block Block, previousBlock Block) bool {
+// syncChain merges a chain received from a peer into the block tree. A
+// chain built on another genesis shares no block with ours, then we
+// either keep ours or replace the whole tree by it. Its genesis, and so
+// the stakes its proposers are drawn from, is the sender's choice, so we
+// only do so while we have no block but our genesis, to join a network.
+func (app *App) syncChain(remote []Block) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(remote) == 0 {
+		return
+	}
+	if bytes.Equal(hashBlock(remote[0]), hashBlock(app.Blocks[0])) {
+		for _, block := range remote[1:] {
+			app.addBlock(block)
+		}
+		return
+	}
+	if len(app.Blocks) > 1 {
+		log.Printf("warn: ignoring a chain built on another genesis")
+		return
+	}
+	chain := app.chooseChain(app.Blocks, remote)
+	if bytes.Equal(chainTipHash(chain), chainTipHash(app.Blocks)) {
+		return
+	}
+	if _, err := app.Ledger.switchChain(app.Blocks, chain); err != nil {
+		log.Printf("error: could not switch chain - %s", err)
+		return
+	}
+	if depth := len(app.Blocks) - 1; depth > 0 {
+		reorg := Reorg{
+			time.Now().UnixMilli(),
+			hex.EncodeToString(chainTipHash(app.Blocks)),
+			hex.EncodeToString(chainTipHash(chain)),
+			"",
+			depth,
+			len(chain) - 1,
+		}
+		log.Printf("warn: reorg! switched to a chain with another genesis, depth: %d", depth)
+		app.Reorgs = append(app.Reorgs, reorg)
+	}
+	app.Tree = newBlockTree(chain[0])
+	for _, block := range chain[1:] {
+		app.Tree.setTip(app.Tree.insert(block, app.Tree.tip))
+	}
+	app.setMainChain(chain)
+}
+
+// hashBlock returns the hash a block is identified and chained by
+func hashBlock(block Block) []byte {
+	hash := sha256.Sum256(headerBytes(block))
+	return hash[:]
+}
+
+// chainTipHash returns the hash of the latest block of chain
+func chainTipHash(chain []Block) []byte {
+	return hashBlock(chain[len(chain)-1])
+}
+
+// isTransactionsValid checks the transactions of block and that the
+// merkle root in its header commits to them
+func isTransactionsValid(block Block) bool {
+	if !bytes.Equal(block.MerkleRoot, merkleRoot(block.Transactions)) {
+		log.Printf("warn: block with id: %d has invalid merkle root", block.Round)
+		return false
+	}
+	for _, tx := range block.Transactions {
+		if !isTransactionValid(tx) {
+			log.Printf("warn: block with id: %d has invalid transaction", block.Round)
+			return false
+		}
+	}
+	return true
+}
+
+// isBlockValid checks block against chain, the chain it is appended to,
+// and stake, the stakes after chain
+func isBlockValid(block Block, chain []Block, stake StakeTable) bool {
+	previousBlock := chain[len(chain)-1]
 	if block.Round != previousBlock.Round+1 {
 		log.Printf("warn: block with id: %d is not the next block after the latest: %d",
 			block.Round, previousBlock.Round)
 		return false
 	}
-	j, _ := json.Marshal(previousBlock)
-	if hash := sha256.Sum256(j); !bytes.Equal(block.PrevHash, hash[:]) {
+	if !bytes.Equal(block.PrevHash, hashBlock(previousBlock)) {
 		log.Printf("warn: block with id: %d has invalid hash", block.Round)
 		return false
 	}
+	if !isTimestampValid(block, chain) {
+		return false
+	}
+	if _, err := checkProducer(block, seedAfter(previousBlock), stake); err != nil {
+		log.Printf("warn: block with id: %d has invalid producer: %s", block.Round, err)
+		return false
+	}
+	if !isTransactionsValid(block) {
+		return false
+	}
 	return true
 }
 
 func (app *App) isChainValid(chain *[]Block) bool {
+	stake := newStakeTable().after((*chain)[0])
 	for i := 1; i < len(*chain); i++ {
-		first := (*chain)[i-1]
-		second := (*chain)[i]
-		if !isBlockValid(second, first) {
+		if !isBlockValid((*chain)[i], (*chain)[:i], stake) {
 			return false
 		}
+		stake = stake.after((*chain)[i])
 	}
 	return true
 }
 
-// We always choose the longest valid chain
+// We always choose the longest valid chain. It is only asked to pick
+// between chains built on different geneses while we have nothing but our
+// genesis, branches sharing ours are chosen by heavier. On a tie the remote
+// chain wins, so that a node that just started adopts the genesis, and the
+// stakes, of the network it joins.
 func (app *App) chooseChain(local []Block, remote []Block) []Block {
 	isLocalValid := app.isChainValid(&local)
 	isRemotevalid := app.isChainValid(&remote)
@@ -0,0 +1,77 @@
+package src
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// BenchResult is what a bench run reports
+type BenchResult struct {
+	Rounds      int     `json:"rounds"`   // of consensus we took part in
+	Blocks      int     `json:"blocks"`   // the main chain grew by
+	Proposed    int     `json:"proposed"` // blocks we were the leader of
+	WallSeconds float64 `json:"wall_s"`
+	CPUSeconds  float64 `json:"cpu_s"` // user and system time of the whole process
+	CPUPerBlock float64 `json:"cpu_s_per_block"`
+	WallRatio   float64 `json:"cpu_wall_ratio"` // about the number of busy cores
+}
+
+// parseBenchLimit reads a bench limit, either a number of blocks or a
+// duration like "30s"
+func parseBenchLimit(arg string) (int, time.Duration, bool) {
+	if blocks, err := strconv.Atoi(arg); err == nil && blocks > 0 {
+		return blocks, 0, true
+	}
+	if duration, err := time.ParseDuration(arg); err == nil && duration > 0 {
+		return 0, duration, true
+	}
+	return 0, 0, false
+}
+
+func (app *App) height() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(app.Blocks)
+}
+
+// bench runs round after round of consensus until the chain has grown by
+// blocks or duration has passed, whichever limit is set. A round isn't
+// interrupted, so a run may take up to one round longer than duration.
+func (app *App) bench(blocks int, duration time.Duration) BenchResult {
+	log.Printf("info: benchmarking...")
+	var result BenchResult
+	cpu, start, height := cpuTime(), time.Now(), app.height()
+	for (blocks == 0 || result.Blocks < blocks) && (duration == 0 || time.Since(start) < duration) {
+		if _, isCast := app.proposeNext(); isCast {
+			result.Proposed++
+		}
+		result.Rounds++
+		result.Blocks = app.height() - height
+	}
+	wall := time.Since(start).Seconds()
+	result.WallSeconds = wall
+	result.CPUSeconds = (cpuTime() - cpu).Seconds()
+	if result.Blocks > 0 {
+		result.CPUPerBlock = result.CPUSeconds / float64(result.Blocks)
+	}
+	result.WallRatio = result.CPUSeconds / wall
+	return result
+}
+
+// logBenchResult writes result as one JSON line to the log and, unless it
+// is empty, to file
+func logBenchResult(result BenchResult, file string) {
+	j, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("warn: can jsonify bench result")
+		return
+	}
+	log.Printf("info: bench: %s", j)
+	if file != "" {
+		if err := AppendLine(file, string(j)); err != nil {
+			log.Printf("warn: can write %s", file)
+		}
+	}
+}
@@ -2,24 +2,30 @@ package src
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
 	"log"
+	"math"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
-const lambda, Lambda, maxStep, maxProposer = 10, 60, 180, 10
+const lambda, Lambda, maxStep = 10, 60, 180
+
+// CONSENSUS tells for every round we took part in whether BA* reached
+// final consensus, agreeing on the block in the first step of BinaryBA*,
+// or only tentative consensus
+var CONSENSUS = map[int]string{}
 
 type Block struct {
-	Round    int    `json:"round"`
-	PrevHash []byte `json:"previous_hash"`
-	SSeed    SSeed  `json:"signature"`
-	Data     string `json:"data"`
+	Round        int           `json:"round"`
+	PrevHash     []byte        `json:"previous_hash"`
+	Timestamp    int64         `json:"timestamp"` // unix milliseconds
+	SSeed        SSeed         `json:"signature"`
+	Cred         Credential    `json:"credential"` // selects the producer as proposer
+	MerkleRoot   []byte        `json:"merkle_root"`
+	Sign         []byte        `json:"block_signature"` // the producer's over headerBytes
+	Transactions []Transaction `json:"transactions"`
 }
 
 type Seed struct {
@@ -41,9 +47,10 @@ type Sign struct {
 }
 
 type Message struct {
-	Block     Block  `json:"block"`
-	Esig      []byte `json:"ephemeral_signature"`
-	Sign      SSeed  `json:"signature"`
+	Block     Block      `json:"block"`
+	Esig      []byte     `json:"ephemeral_signature"`
+	Sign      SSeed      `json:"signature"`
+	PartKey   PartKey    `json:"participation_key"` // Esig is made with
 }
 
 type Value struct {
@@ -52,56 +59,99 @@ type Value struct {
 }
 
 type Message23 struct {
-	PeerID     peer.ID `json:"peer_id"`
-	Value      Value   `json:"value"`
-	ValueESign []byte  `json:"value_sign"`
-	Sign       Sign    `json:"signature"`
+	PeerID     peer.ID    `json:"peer_id"`
+	Value      Value      `json:"value"`
+	ValueESign []byte     `json:"value_sign"`
+	Sign       Sign       `json:"signature"`
+	Cred       Credential `json:"credential"` // selects the sender for the step
+	PartKey    PartKey    `json:"participation_key"` // the ephemeral signatures are made with
 }
 
 type Message4 struct {
-	PeerID     peer.ID `json:"peer_id"`
-	Bit        int     `json:"bit"`
-	BESign     []byte  `json:"b_sign"`
-	Value      Value   `json:"value"`
-	ValueESign []byte  `json:"value_sign"`
-	Sign       Sign    `json:"signature"`
+	PeerID     peer.ID    `json:"peer_id"`
+	Bit        int        `json:"bit"`
+	BESign     []byte     `json:"b_sign"`
+	Value      Value      `json:"value"`
+	ValueESign []byte     `json:"value_sign"`
+	Sign       Sign       `json:"signature"`
+	Cred       Credential `json:"credential"` // selects the sender for the step
+	PartKey    PartKey    `json:"participation_key"` // the ephemeral signatures are made with
+}
+
+// blockProducer is who gets the coinbase of block, the leader. Blocks are
+// only accepted from a proposer of their round, see checkProducer.
+func blockProducer(block Block) peer.ID {
+	return block.SSeed.PeerID
+}
+
+// blockRewards returns the coins block creates, the leader gets them all.
+// The genesis block creates the genesis allocation.
+func blockRewards(block Block) map[peer.ID]int {
+	if block.Round < 0 {
+		allocation := map[peer.ID]int{}
+		for _, tx := range block.Transactions {
+			allocation[tx.Recipient] += tx.Amount
+		}
+		return allocation
+	}
+	return map[peer.ID]int{blockProducer(block): BLOCK_REWARD}
 }
 
 func createSSeed(seed string) SSeed {
-	hash := sha256.Sum256([]byte(seed))
-	sign, _ := ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
-	return SSeed{PEER_ID, seed, sign}
+	return SSeed{PEER_ID, seed, signData([]byte(seed))}
 }
 
 func createSign(round int, step int, seed string) Sign {
 	s := Seed{round, step, seed}
-	j, _ := json.Marshal(s)
-	hash := sha256.Sum256(j)
-	sign, _ := ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
-	return Sign{PEER_ID, s, sign}
+	return Sign{PEER_ID, s, signData(seedBytes(s))}
 }
 
-func newBlock(round int, prevHash []byte, seed string, data string) (Block, bool) {
-	if len(MESSAGES) >= maxProposer {
-		log.Printf("info: you are not a selected user")
-		return Block{}, false // invalid block
+// vote signs for step of round and runs sortition for its committee
+func vote(round int, step int, seed string, stake StakeTable) (Sign, Credential, bool) {
+	sign := createSign(round, step, seed)
+	cred, isMember := createCredential(sign.Seed, COMMITTEE, stake)
+	if !isMember {
+		log.Printf("info: you are not in the committee of step%d", step)
 	}
+	return sign, cred, isMember
+}
+
+func newBlock(round int, prevHash []byte, seed string, stake StakeTable, pool *Mempool) (Block, bool) {
 	block := Block{
 		round,
 		prevHash,
+		time.Now().UnixMilli(),
 		createSSeed(seed),
-		data,
+		Credential{},
+		nil,
+		nil,
+		pool.pending(MAX_BLOCK_TXS),
+	}
+	block.MerkleRoot = merkleRoot(block.Transactions)
+	if m, isSent := MESSAGE_STORE.ownProposal(round); isSent {
+		log.Printf("info: proposing block again...")
+		block = m.Block
+		Publish(MessageRequest{m, PEER_ID})
+	} else if cred, isProposer := createCredential(Seed{round, 1, seed}, PROPOSERS, stake); isProposer {
+		block.Cred = cred
+		block.Sign = signData(headerBytes(block))
+		step1(block, stake)
+	} else {
+		log.Printf("info: you are not a selected proposer")
 	}
-	step1(block)
-	tH := step2(round, seed)
-	step3(round, seed, tH)
-	value := step4(round, seed, tH)
+	tH := step2(round, seed, stake)
+	step3(round, seed, stake, tH)
+	value := step4(round, seed, stake, tH)
 	newBlockValue := Value{Leader: "nil"}
 	found := false
+	kind := "tentative"
 	for step := 5; step < maxStep; step++ {
 		if newBlockValue0, isFine0 := isFinalized0(round, step, tH); isFine0 {
 			newBlockValue = newBlockValue0
 			found = true
+			if step == 5 {
+				kind = "final"
+			}
 			break
 		} else if newBlockValue1, isFine1 := isFinalized1(round, step, tH); isFine1 {
 			newBlockValue = newBlockValue1
@@ -110,15 +160,19 @@ func newBlock(round int, prevHash []byte, seed string, data string) (Block, bool
 		}
 		switch step % 3 {
 		case 2:
-			step5(round, step, seed, value, tH)
+			step5(round, step, seed, stake, value, tH)
 		case 0:
-			step6(round, step, seed, value, tH)
+			step6(round, step, seed, stake, value, tH)
 		case 1:
-			step7(round, step, seed, value, tH)
+			step7(round, step, seed, stake, value, tH)
 		}
 	}
 
-	MESSAGES, MESSAGES2, MESSAGES3, MESSAGES4 = []Message{}, []Message23{}, []Message23{}, []Message4{}
+	if found {
+		mutex.Lock()
+		CONSENSUS[round] = kind
+		mutex.Unlock()
+	}
 
 	if found && PEER_ID == newBlockValue.Leader {
 		return block, true
@@ -126,71 +180,80 @@ func newBlock(round int, prevHash []byte, seed string, data string) (Block, bool
 	return Block{}, false // invalid block
 }
 
-func step1(block Block) {
+func step1(block Block, stake StakeTable) {
 	log.Printf("info: proposing block...")
-	j, _ := json.Marshal(block)
-	hash := sha256.Sum256(j)
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	esign, _ := ecdsa.SignASN1(rand.Reader, priv, hash[:])
-	m := Message{block, esign, block.SSeed}
-	mutex.Lock()
-	MESSAGES = append(MESSAGES, m)
-	mutex.Unlock()
+	partKey, esigns := ephemeralSign(stake, block.Round, 1, headerBytes(block))
+	if len(esigns) == 0 {
+		return
+	}
+	m := Message{block, esigns[0], block.SSeed, partKey}
+	MESSAGE_STORE.addProposal(m)
 	Publish(MessageRequest{m, PEER_ID})
 }
 
-func findLeader(round int) Message {
-	var lead [32]byte
+// findLeader returns the proposal of round with the lowest priority
+func findLeader(round int) (Message, bool) {
+	var lead []byte
 	num := -1
-	for i, message := range MESSAGES {
-		if message.Block.Round == round {
-			j, _ := json.Marshal(message)
-			if num < 0 {
-				num, lead = i, sha256.Sum256(j)
-			} else if lead2 := sha256.Sum256(j);
-					bytes.Compare(lead[:], lead2[:]) == 1 {
-				num, lead = i, lead2
-			}
+	proposals := MESSAGE_STORE.proposals(round)
+	for i, message := range proposals {
+		if lead2 := priority(message.Block.Cred); num < 0 || bytes.Compare(lead, lead2) == 1 {
+			num, lead = i, lead2
 		}
 	}
-	return MESSAGES[num]
+	if num < 0 {
+		return Message{}, false
+	}
+	return proposals[num], true
 }
 
-func sendMessage2(value Value, round int, seed string) {
-	v, _ := json.Marshal(value)
-	h := sha256.Sum256(v)
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	esign, _ := ecdsa.SignASN1(rand.Reader, priv, h[:])
-	sign := createSign(round, 2, seed)
-	m := Message23{PEER_ID, value, esign, sign}
-	mutex.Lock()
-	MESSAGES2 = append(MESSAGES2, m)
-	mutex.Unlock()
+func sendMessage2(value Value, round int, seed string, stake StakeTable) {
+	if m, isSent := MESSAGE_STORE.ownVote23(round, 2); isSent {
+		Publish(Message23Request{m, PEER_ID})
+		return
+	}
+	sign, cred, isMember := vote(round, 2, seed, stake)
+	if !isMember {
+		return
+	}
+	partKey, esigns := ephemeralSign(stake, round, 2, valueVoteBytes(sign.Seed, value))
+	if len(esigns) == 0 {
+		return
+	}
+	m := Message23{PEER_ID, value, esigns[0], sign, cred, partKey}
+	MESSAGE_STORE.addVote23(m)
 	Publish(Message23Request{m, PEER_ID})
 }
 
-func sendMessage3(value Value, round int, seed string) {
-	v, _ := json.Marshal(value)
-	h := sha256.Sum256(v)
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	esign, _ := ecdsa.SignASN1(rand.Reader, priv, h[:])
-	sign := createSign(round, 3, seed)
-	m := Message23{PEER_ID, value, esign, sign}
-	mutex.Lock()
-	MESSAGES3 = append(MESSAGES3, m)
-	mutex.Unlock()
+func sendMessage3(value Value, round int, seed string, stake StakeTable) {
+	if m, isSent := MESSAGE_STORE.ownVote23(round, 3); isSent {
+		Publish(Message23Request{m, PEER_ID})
+		return
+	}
+	sign, cred, isMember := vote(round, 3, seed, stake)
+	if !isMember {
+		return
+	}
+	partKey, esigns := ephemeralSign(stake, round, 3, valueVoteBytes(sign.Seed, value))
+	if len(esigns) == 0 {
+		return
+	}
+	m := Message23{PEER_ID, value, esigns[0], sign, cred, partKey}
+	MESSAGE_STORE.addVote23(m)
 	Publish(Message23Request{m, PEER_ID})
 }
 
-func calcTH(round int) int {
-	num := 0.0
-	for _, m := range MESSAGES {
-		if m.Block.Round == round { num++ }
+// calcTH is the votes a value needs in a step, 69% of the expected
+// committee size, which is smaller than COMMITTEE if there is less stake
+func calcTH(stake StakeTable) int {
+	expected := COMMITTEE
+	if stake.total < expected {
+		expected = stake.total
 	}
-	return int(0.69 * num)
+	return int(math.Ceil(0.69 * float64(expected)))
 }
 
-func step2(round int, seed string) int {
+func step2(round int, seed string, stake StakeTable) int {
 	log.Printf("info: step2...")
 	c1, c2 := make(chan Value), make(chan Value)
 	go func() {
@@ -200,10 +263,9 @@ func step2(round int, seed string) int {
 
 	go func() {
 		time.Sleep(2*lambda * time.Second)
-		lead := findLeader(round)
-		j, _ := json.Marshal(lead.Block)
-		hash := sha256.Sum256(j)
-		c2 <- Value{hash[:], lead.Sign.PeerID}
+		if lead, isFound := findLeader(round); isFound {
+			c2 <- Value{hashBlock(lead.Block), lead.Sign.PeerID}
+		}
 	}()
 	var value Value
 	select {
@@ -211,31 +273,24 @@ func step2(round int, seed string) int {
 		log.Printf("info: can't find value")
 	case value = <-c2:
 	}
-	sendMessage2(value, round, seed)
-	return calcTH(round)
-}
-
-func isLeader(value Value, values []Value, tH int) bool {
-	count := 0
-	for _, v := range values {
-		if value.Leader == v.Leader { count++ }
-		if count >= tH { return true }
-	}
-	return false
+	sendMessage2(value, round, seed, stake)
+	return calcTH(stake)
 }
 
+// findValue returns the value of round whose leader got at least tH
+// votes
 func findValue(messages []Message23, round int, tH int) (Value, bool) {
-	var values []Value
+	votes := map[peer.ID]int{} // by leader
 	for _, m := range messages {
 		if m.Sign.Seed.Round == round {
-			values = append(values, m.Value)
-			if isLeader(m.Value, values, tH) { return m.Value, true }
+			votes[m.Value.Leader] += m.Cred.Votes
+			if votes[m.Value.Leader] >= tH { return m.Value, true }
 		}
 	}
 	return Value{}, false
 }
 
-func step3(round int, seed string, tH int) {
+func step3(round int, seed string, stake StakeTable, tH int) {
 	log.Printf("info: step3...")
 	c1, c2 := make(chan Value), make(chan Value)
 	go func() {
@@ -247,7 +302,7 @@ func step3(round int, seed string, tH int) {
 		var tmp Value
 		var isFound bool
 		for {
-			if tmp, isFound = findValue(MESSAGES2, round, tH); isFound { break }
+			if tmp, isFound = findValue(MESSAGE_STORE.votes23(round, 2), round, tH); isFound { break }
 			time.Sleep(100 * time.Millisecond)
 		}
 		c2 <- tmp
@@ -258,31 +313,35 @@ func step3(round int, seed string, tH int) {
 		log.Printf("info: can't find value")
 	case value = <-c2:
 	}
-	sendMessage3(value, round, seed)
+	sendMessage3(value, round, seed, stake)
 }
 
-func sendMessage4(bit int, value Value, round int, step int, seed string) {
-	bj, _ := json.Marshal(bit)
-	vj, _ := json.Marshal(value)
-	bh, vh := sha256.Sum256(bj), sha256.Sum256(vj)
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	besign, _ := ecdsa.SignASN1(rand.Reader, priv, bh[:])
-	vesign, _ := ecdsa.SignASN1(rand.Reader, priv, vh[:])
-	sign := createSign(round, step, seed)
-	m := Message4{PEER_ID, bit, besign, value, vesign, sign}
-	mutex.Lock()
-	MESSAGES4 = append(MESSAGES4, m)
-	mutex.Unlock()
+func sendMessage4(bit int, value Value, round int, step int, seed string, stake StakeTable) {
+	if m, isSent := MESSAGE_STORE.ownVote4(round, step); isSent {
+		Publish(Message4Request{m, PEER_ID})
+		return
+	}
+	sign, cred, isMember := vote(round, step, seed, stake)
+	if !isMember {
+		return
+	}
+	partKey, esigns := ephemeralSign(stake, round, step,
+		bitVoteBytes(sign.Seed, bit), valueVoteBytes(sign.Seed, value))
+	if len(esigns) == 0 {
+		return
+	}
+	m := Message4{PEER_ID, bit, esigns[0], value, esigns[1], sign, cred, partKey}
+	MESSAGE_STORE.addVote4(m)
 	Publish(Message4Request{m, PEER_ID})
 }
 
-func step4(round int, seed string, tH int) Value {
+func step4(round int, seed string, stake StakeTable, tH int) Value {
 	log.Printf("info: step4...")
 	c1, c2 := make(chan Value), make(chan Value)
 	var g int
 	go func() {
 		time.Sleep(2*lambda * time.Second)
-		tmp, isFound := findValue(MESSAGES3, round, tH/2)
+		tmp, isFound := findValue(MESSAGE_STORE.votes23(round, 3), round, tH/2)
 		if isFound {
 			if tmp.Leader != "nil" {g = 1} else {g = 0}
 		}
@@ -293,7 +352,7 @@ func step4(round int, seed string, tH int) Value {
 		var tmp Value
 		var isFound bool
 		for {
-			if tmp, isFound = findValue(MESSAGES3, round, tH); isFound { break }
+			if tmp, isFound = findValue(MESSAGE_STORE.votes23(round, 3), round, tH); isFound { break }
 			time.Sleep(100 * time.Millisecond)
 		}
 		if tmp.Leader != "nil" {g = 2} else {g = 0}
@@ -307,14 +366,14 @@ func step4(round int, seed string, tH int) Value {
 	case value = <-c2:
 	}
 	if g == 2 {bit = 0} else {bit = 1}
-	sendMessage4(bit, value, round, 4, seed)
+	sendMessage4(bit, value, round, 4, seed, stake)
 	return value
 }
 
 func isFinalized0(round int, step int, tH int) (Value, bool) {
 	var valids []Message4
 	var count int
-	for _, m := range MESSAGES4 {
+	for _, m := range MESSAGE_STORE.votes4(round) {
 		s := m.Sign.Seed.Step + 1
 		if (m.Sign.Seed.Round == round &&
 				m.Value.Leader != "nil" &&
@@ -327,19 +386,19 @@ func isFinalized0(round int, step int, tH int) (Value, bool) {
 				if (v.Bit == 0 &&
 						v.Sign.Seed.Step == s - 1 &&
 						bytes.Equal(m.Value.HashBlock, v.Value.HashBlock)) {
-					count++
+					count += v.Cred.Votes
 				}
 				if count >= tH {return m.Value, true}
 			}
 		}
 	}
-	return MESSAGES4[0].Value, false
+	return Value{}, false
 }
 
 func isFinalized1(round int, step int, tH int) (Value, bool) {
 	var valids []Message4
 	var count int
-	for _, m := range MESSAGES4 {
+	for _, m := range MESSAGE_STORE.votes4(round) {
 		s := m.Sign.Seed.Step + 1
 		if (m.Sign.Seed.Round == round &&
 				6 <= s && s <= step &&
@@ -351,19 +410,19 @@ func isFinalized1(round int, step int, tH int) (Value, bool) {
 				if (v.Bit == 1 &&
 						v.Sign.Seed.Step == s - 1 &&
 						bytes.Equal(m.Value.HashBlock, v.Value.HashBlock)) {
-					count++
+					count += v.Cred.Votes
 				}
 				if count >= tH {return m.Value, true}
 			}
 		}
 	}
-	return MESSAGES4[0].Value, false
+	return Value{}, false
 }
 
 func coinFlipped(round int, step int, tH int, bit int) bool {
 	var valids []Message4
 	var count int
-	for _, m := range MESSAGES4 {
+	for _, m := range MESSAGE_STORE.votes4(round) {
 		s := m.Sign.Seed.Step + 1
 		if (m.Sign.Seed.Round == round && step == s && m.Bit == bit) {
 			count = 0
@@ -372,7 +431,7 @@ func coinFlipped(round int, step int, tH int, bit int) bool {
 				if (v.Bit == bit &&
 						v.Sign.Seed.Step == s - 1 &&
 						bytes.Equal(m.Value.HashBlock, v.Value.HashBlock)) {
-					count++
+					count += v.Cred.Votes
 				}
 				if count >= tH {
 					return true
@@ -383,7 +442,7 @@ func coinFlipped(round int, step int, tH int, bit int) bool {
 	return false
 }
 
-func step5(round int, step int, seed string, value Value, tH int) {
+func step5(round int, step int, seed string, stake StakeTable, value Value, tH int) {
 	log.Printf("info: step%d...", step)
 	bit1, bit2 := make(chan int), make(chan int)
 	go func() {
@@ -403,10 +462,10 @@ func step5(round int, step int, seed string, value Value, tH int) {
 		log.Printf("info: can't find value")
 	case bit = <-bit2:
 	}
-	sendMessage4(bit, value, round, step, seed)
+	sendMessage4(bit, value, round, step, seed, stake)
 }
 
-func step6(round int, step int, seed string, value Value, tH int) {
+func step6(round int, step int, seed string, stake StakeTable, value Value, tH int) {
 	log.Printf("info: step%d...", step)
 	bit1, bit2 := make(chan int), make(chan int)
 	go func() {
@@ -426,17 +485,19 @@ func step6(round int, step int, seed string, value Value, tH int) {
 		log.Printf("info: can't find value")
 	case bit = <-bit2:
 	}
-	sendMessage4(bit, value, round, step, seed)
+	sendMessage4(bit, value, round, step, seed, stake)
 }
 
-func step7(round int, step int, seed string, value Value, tH int) {
+func step7(round int, step int, seed string, stake StakeTable, value Value, tH int) {
 	log.Printf("info: step%d...", step)
 	bit1, bit2, bit3 := make(chan int), make(chan int), make(chan int)
 	go func() {
 		time.Sleep(2*lambda * time.Second)
-		lead := findLeader(round)
-		j, _ := json.Marshal([]interface{} {lead.Sign, round})
-		hash := sha256.Sum256(j)
+		// without a proposal the coin falls back to the seed
+		hash := sha256.Sum256(seedBytes(Seed{round, step, seed}))
+		if lead, isFound := findLeader(round); isFound {
+			hash = sha256.Sum256(sseedBytes(lead.Sign, round))
+		}
 		bit1 <- int(hash[31]) % 2
 	}()
 	go func() {
@@ -461,5 +522,5 @@ func step7(round int, step int, seed string, value Value, tH int) {
 	case bit = <-bit2:
 	case bit = <-bit3:
 	}
-	sendMessage4(bit, value, round, step, seed)
+	sendMessage4(bit, value, round, step, seed, stake)
 }
@@ -0,0 +1,204 @@
+package src
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log"
+	"math/big"
+	"time"
+)
+
+var MAX_ORPHANS = 100 // orphan blocks kept while waiting for their parent
+
+type treeNode struct {
+	block  Block
+	hash   string
+	parent *treeNode
+	height int        // genesis is 0
+	weight *big.Int   // fork-choice weight of the branch up to this block
+	stake  StakeTable // the stakes after this block, see StakeTable.after
+}
+
+// Reorg records the main chain switching over to another branch
+type Reorg struct {
+	Time   int64  `json:"time"` // unix milliseconds
+	OldTip string `json:"old_tip"`
+	NewTip string `json:"new_tip"`
+	Fork   string `json:"fork"`  // last block both branches share
+	Depth  int    `json:"depth"` // blocks taken off the old main chain
+	Added  int    `json:"added"` // blocks put on the new main chain
+}
+
+// BlockTree keeps every valid block indexed by hash, so that competing
+// branches survive until one of them wins, and holds orphan blocks until
+// their parent arrives
+type BlockTree struct {
+	nodes   map[string]*treeNode
+	orphans []Block
+	root    *treeNode
+	tip     *treeNode
+}
+
+func newBlockTree(genesis Block) *BlockTree {
+	root := &treeNode{
+		genesis,
+		hex.EncodeToString(hashBlock(genesis)),
+		nil,
+		0,
+		blockWeight(genesis),
+		newStakeTable().after(genesis),
+	}
+	return &BlockTree{map[string]*treeNode{root.hash: root}, []Block{}, root, root}
+}
+
+func (tree *BlockTree) get(hash []byte) *treeNode {
+	return tree.nodes[hex.EncodeToString(hash)]
+}
+
+// chainTo returns the blocks from genesis up to node
+func (tree *BlockTree) chainTo(node *treeNode) []Block {
+	chain := make([]Block, node.height+1)
+	for n := node; n != nil; n = n.parent {
+		chain[n.height] = n.block
+	}
+	return chain
+}
+
+func (tree *BlockTree) insert(block Block, parent *treeNode) *treeNode {
+	node := &treeNode{
+		block,
+		hex.EncodeToString(hashBlock(block)),
+		parent,
+		parent.height + 1,
+		new(big.Int).Add(parent.weight, blockWeight(block)),
+		parent.stake.after(block),
+	}
+	tree.nodes[node.hash] = node
+	return node
+}
+
+// leaves returns the tips of all branches
+func (tree *BlockTree) leaves() []*treeNode {
+	parents := map[*treeNode]bool{}
+	for _, node := range tree.nodes {
+		parents[node.parent] = true
+	}
+	leaves := []*treeNode{}
+	for _, node := range tree.nodes {
+		if !parents[node] {
+			leaves = append(leaves, node)
+		}
+	}
+	return leaves
+}
+
+// prune drops node and everything built on it
+func (tree *BlockTree) prune(node *treeNode) {
+	for hash, n := range tree.nodes {
+		for a := n; a != nil && a.height >= node.height; a = a.parent {
+			if a == node {
+				delete(tree.nodes, hash)
+				break
+			}
+		}
+	}
+}
+
+func (tree *BlockTree) addOrphan(block Block) {
+	if len(tree.orphans) >= MAX_ORPHANS {
+		tree.orphans = tree.orphans[1:]
+	}
+	tree.orphans = append(tree.orphans, block)
+}
+
+// orphan returns the orphan with hash, if there is one
+func (tree *BlockTree) orphan(hash []byte) (Block, bool) {
+	for _, orphan := range tree.orphans {
+		if bytes.Equal(hashBlock(orphan), hash) {
+			return orphan, true
+		}
+	}
+	return Block{}, false
+}
+
+// takeOrphans removes and returns the orphans whose parent is node
+func (tree *BlockTree) takeOrphans(node *treeNode) []Block {
+	taken, kept := []Block{}, []Block{}
+	for _, orphan := range tree.orphans {
+		if hex.EncodeToString(orphan.PrevHash) == node.hash {
+			taken = append(taken, orphan)
+		} else {
+			kept = append(kept, orphan)
+		}
+	}
+	tree.orphans = kept
+	return taken
+}
+
+// confirmations returns the number of main chain blocks from node up to
+// the tip, node included, or 0 if node isn't on the main chain
+func (tree *BlockTree) confirmations(node *treeNode) int {
+	a := tree.tip
+	for a != nil && a.height > node.height {
+		a = a.parent
+	}
+	if a != node {
+		return 0
+	}
+	return tree.tip.height - node.height + 1
+}
+
+// heavier reports whether the branch ending in a beats the one ending in b.
+// On equal weight the lower tip hash wins, so every node picks the same one.
+func heavier(a *treeNode, b *treeNode) bool {
+	if c := a.weight.Cmp(b.weight); c != 0 {
+		return c > 0
+	}
+	return a.hash < b.hash
+}
+
+// forkIndex returns the index of the first block the chains a and b
+// don't share
+func forkIndex(a []Block, b []Block) int {
+	fork := 0
+	for fork < len(a) && fork < len(b) &&
+		bytes.Equal(hashBlock(a[fork]), hashBlock(b[fork])) {
+		fork++
+	}
+	return fork
+}
+
+func commonAncestor(a *treeNode, b *treeNode) *treeNode {
+	for a.height > b.height {
+		a = a.parent
+	}
+	for b.height > a.height {
+		b = b.parent
+	}
+	for a != b {
+		a, b = a.parent, b.parent
+	}
+	return a
+}
+
+// setTip makes node the tip, it reports a reorg unless node simply extends
+// the old tip
+func (tree *BlockTree) setTip(node *treeNode) (Reorg, bool) {
+	old := tree.tip
+	tree.tip = node
+	fork := commonAncestor(old, node)
+	if fork == old {
+		return Reorg{}, false
+	}
+	reorg := Reorg{
+		time.Now().UnixMilli(),
+		old.hash,
+		node.hash,
+		fork.hash,
+		old.height - fork.height,
+		node.height - fork.height,
+	}
+	log.Printf("warn: reorg! depth: %d, old tip: %s, new tip: %s",
+		reorg.Depth, reorg.OldTip, reorg.NewTip)
+	return reorg, true
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package src
+
+import (
+	"log"
+	"syscall"
+	"time"
+)
+
+// cpuTime is the user and system CPU time the process has used so far
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		log.Printf("warn: can read rusage")
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
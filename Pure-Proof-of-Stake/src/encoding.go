@@ -0,0 +1,120 @@
+package src
+
+import (
+	"encoding/binary"
+)
+
+// ENCODING_VERSION leads every encoding below and changes whenever their
+// layout does
+const ENCODING_VERSION = 2
+
+// Blocks, transactions and the BA* values are hashed and signed over a
+// canonical binary encoding, JSON is only used on the wire and for
+// display. Integers are big-endian, int fields are encoded as 64 bits,
+// and byte strings (peer ids, seeds, keys, hashes, payloads) are
+// prefixed by their uint32 length:
+//
+//	header:      version u8 | round i64 | previous_hash bytes |
+//	             timestamp i64 | peer_id bytes | seed bytes |
+//	             seed_signature bytes | credential | merkle_root bytes
+//	credential:  public_key bytes | proof bytes | votes i64
+//	transaction: version u8 | sender bytes | recipient bytes |
+//	             payload bytes | amount i64 | fee i64 | nonce i64 |
+//	             public_key bytes
+//	seed:        version u8 | round i64 | step i64 | seed bytes
+//	signed seed: version u8 | peer_id bytes | seed bytes |
+//	             seed_signature bytes | round i64
+//	value:       version u8 | hashblock bytes | leader bytes
+//	bit:         version u8 | bit i64
+//	value vote:  seed | value
+//	bit vote:    seed | bit
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendInt(buf []byte, v int) []byte {
+	return appendUint64(buf, uint64(int64(v)))
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	return append(append(buf, l[:]...), b...)
+}
+
+func appendSSeed(buf []byte, s SSeed) []byte {
+	buf = appendBytes(buf, []byte(s.PeerID))
+	buf = appendBytes(buf, []byte(s.Seed))
+	return appendBytes(buf, s.Sign)
+}
+
+func appendCredential(buf []byte, cred Credential) []byte {
+	buf = appendBytes(buf, cred.PubKey)
+	buf = appendBytes(buf, cred.Proof)
+	return appendInt(buf, cred.Votes)
+}
+
+// headerBytes is what the block hash and the producer's signature cover,
+// that is everything but the signature and the transactions, which are
+// committed to by the merkle root
+func headerBytes(block Block) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendInt(buf, block.Round)
+	buf = appendBytes(buf, block.PrevHash)
+	buf = appendUint64(buf, uint64(block.Timestamp))
+	buf = appendSSeed(buf, block.SSeed)
+	buf = appendCredential(buf, block.Cred)
+	return appendBytes(buf, block.MerkleRoot)
+}
+
+// txBytes is what the sender's signature and the transaction hash cover
+func txBytes(tx Transaction) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendBytes(buf, []byte(tx.Sender))
+	buf = appendBytes(buf, []byte(tx.Recipient))
+	buf = appendBytes(buf, []byte(tx.Payload))
+	buf = appendInt(buf, tx.Amount)
+	buf = appendInt(buf, tx.Fee)
+	buf = appendInt(buf, tx.Nonce)
+	return appendBytes(buf, tx.PubKey)
+}
+
+// seedBytes is what a committee member signs for a step, and the input
+// of the VRF of sortition
+func seedBytes(s Seed) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendInt(buf, s.Round)
+	buf = appendInt(buf, s.Step)
+	return appendBytes(buf, []byte(s.Seed))
+}
+
+// sseedBytes binds the signed seed of a proposer to round, it is hashed
+// for the next seed and the common coin
+func sseedBytes(s SSeed, round int) []byte {
+	return appendInt(appendSSeed([]byte{ENCODING_VERSION}, s), round)
+}
+
+func valueBytes(value Value) []byte {
+	buf := []byte{ENCODING_VERSION}
+	buf = appendBytes(buf, value.HashBlock)
+	return appendBytes(buf, []byte(value.Leader))
+}
+
+func bitBytes(bit int) []byte {
+	return appendInt([]byte{ENCODING_VERSION}, bit)
+}
+
+// valueVoteBytes is what a committee member signs to vote for value in
+// the step s names
+func valueVoteBytes(s Seed, value Value) []byte {
+	return append(seedBytes(s), valueBytes(value)...)
+}
+
+// bitVoteBytes is what a committee member signs to vote for bit in the
+// step s names
+func bitVoteBytes(s Seed, bit int) []byte {
+	return append(seedBytes(s), bitBytes(bit)...)
+}
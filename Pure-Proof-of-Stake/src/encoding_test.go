@@ -0,0 +1,100 @@
+package src
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// encodingVector pins the encoding of a fixed sample and its sha256, so
+// that other implementations can check theirs against it
+type encodingVector struct {
+	name     string
+	encoding []byte
+	want     string // hex of the encoding
+	hash     string // hex of its sha256
+}
+
+var vectorTx = Transaction{
+	"sender",
+	"recipient",
+	"hello",
+	10,
+	2,
+	1,
+	[]byte{0x01, 0x02, 0x03},
+	[]byte{0xff}, // not covered
+}
+
+var vectorBlock = Block{
+	1,
+	bytes.Repeat([]byte{0xaa}, 32),
+	1700000000000,
+	SSeed{"leader", "seed", []byte{0x04, 0x05}},
+	Credential{[]byte{0x06}, []byte{0x07, 0x08}, 3},
+	bytes.Repeat([]byte{0xbb}, 32),
+	[]byte{0xff}, // not covered
+	nil,
+}
+
+var vectorSeed = Seed{1, 2, "seed"}
+
+var vectorValue = Value{bytes.Repeat([]byte{0xcc}, 32), "leader"}
+
+func encodingVectors() []encodingVector {
+	return []encodingVector{
+		{"transaction", txBytes(vectorTx),
+			"02" +
+				"00000006" + "73656e646572" +
+				"00000009" + "726563697069656e74" +
+				"00000005" + "68656c6c6f" +
+				"000000000000000a" +
+				"0000000000000002" +
+				"0000000000000001" +
+				"00000003" + "010203",
+			"afb466c44c95d9ccf0f9826f06d9c503398d96d5e57dafd1b071f6fb34f685d9"},
+		{"header", headerBytes(vectorBlock),
+			"02" +
+				"0000000000000001" +
+				"00000020" + "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" +
+				"0000018bcfe56800" +
+				"00000006" + "6c6561646572" +
+				"00000004" + "73656564" +
+				"00000002" + "0405" +
+				"00000001" + "06" +
+				"00000002" + "0708" +
+				"0000000000000003" +
+				"00000020" + "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb",
+			"3171029a5e7e73126b9fdb68285779a7ee5a0d166afacc1a62e95a53796159bf"},
+		{"seed", seedBytes(vectorSeed),
+			"02" +
+				"0000000000000001" +
+				"0000000000000002" +
+				"00000004" + "73656564",
+			"18e98fef03b09b6760965f1256634407487013084a8d683ab54dcba6692d5365"},
+		{"value", valueBytes(vectorValue),
+			"02" +
+				"00000020" + "cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc" +
+				"00000006" + "6c6561646572",
+			"ab45a3282d879ddc1e5b9b84ac2bb6153d13ed0f24713ac271db0683e23385f7"},
+		{"bit", bitBytes(1),
+			"02" +
+				"0000000000000001",
+			"f83f60940c1ec44c0f1e90f694c6cae7c99b4b6d1507d60ad5a3282a7750d0ee"},
+	}
+}
+
+// TestEncodingVectors fails if the encodings above have drifted from the
+// pinned ones
+func TestEncodingVectors(t *testing.T) {
+	for _, v := range encodingVectors() {
+		hash := sha256.Sum256(v.encoding)
+		if got := hex.EncodeToString(v.encoding); got != v.want {
+			t.Errorf("%s encoding is %s, want %s", v.name, got, v.want)
+		}
+		if got := hex.EncodeToString(hash[:]); got != v.hash {
+			t.Errorf("%s hash is %s, want %s", v.name, got, v.hash)
+		}
+	}
+}
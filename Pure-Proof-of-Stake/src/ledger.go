@@ -0,0 +1,139 @@
+package src
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var BLOCK_REWARD = 50 // coins the producer of a block gets on top of the fees
+
+type Account struct {
+	Balance int `json:"balance"`
+	Nonce   int `json:"nonce"` // nonce of the last transaction sent
+}
+
+// Ledger is the account state after the last block of the main chain. For
+// every applied block it keeps the previous state of the accounts the
+// block touched, so that a fork switch can roll it back.
+type Ledger struct {
+	mutex    sync.Mutex
+	accounts map[peer.ID]Account
+	undos    map[string]map[peer.ID]Account // by block hash
+}
+
+func newLedger() *Ledger {
+	return &Ledger{accounts: map[peer.ID]Account{}, undos: map[string]map[peer.ID]Account{}}
+}
+
+func (ledger *Ledger) account(id peer.ID) Account {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	return ledger.accounts[id]
+}
+
+// load returns the account id of the working copy accounts, taking it from
+// the ledger on first use. ledger.mutex must be held.
+func (ledger *Ledger) load(accounts map[peer.ID]Account, id peer.ID) Account {
+	if account, ok := accounts[id]; ok {
+		return account
+	}
+	return ledger.accounts[id]
+}
+
+// applyTx applies tx to the working copy accounts. ledger.mutex must be
+// held.
+func (ledger *Ledger) applyTx(accounts map[peer.ID]Account, tx Transaction) error {
+	if tx.Amount < 0 || tx.Fee < 0 {
+		return fmt.Errorf("transaction from %s has a negative amount", tx.Sender)
+	}
+	sender := ledger.load(accounts, tx.Sender)
+	if tx.Nonce != sender.Nonce+1 {
+		return fmt.Errorf("transaction from %s has nonce %d, expected %d",
+			tx.Sender, tx.Nonce, sender.Nonce+1)
+	}
+	if sender.Balance < tx.Amount+tx.Fee {
+		return fmt.Errorf("transaction from %s exceeds its balance", tx.Sender)
+	}
+	sender.Balance -= tx.Amount + tx.Fee
+	sender.Nonce++
+	accounts[tx.Sender] = sender
+	recipient := ledger.load(accounts, tx.Recipient)
+	recipient.Balance += tx.Amount
+	accounts[tx.Recipient] = recipient
+	return nil
+}
+
+// apply applies the transactions and the coinbase of block, that is its
+// rewards and fees. The transactions of the genesis block aren't applied,
+// it only creates the coins blockRewards gives. ledger.mutex must be held.
+func (ledger *Ledger) apply(block Block) error {
+	txs := block.Transactions
+	if block.Round < 0 {
+		txs = nil
+	}
+	accounts := map[peer.ID]Account{}
+	fees := 0
+	for _, tx := range txs {
+		if err := ledger.applyTx(accounts, tx); err != nil {
+			return err
+		}
+		fees += tx.Fee
+	}
+	rewards := blockRewards(block)
+	rewards[blockProducer(block)] += fees
+	for id, reward := range rewards {
+		account := ledger.load(accounts, id)
+		account.Balance += reward
+		accounts[id] = account
+	}
+
+	undo := map[peer.ID]Account{}
+	for id, account := range accounts {
+		undo[id] = ledger.accounts[id]
+		ledger.accounts[id] = account
+	}
+	ledger.undos[hex.EncodeToString(hashBlock(block))] = undo
+	return nil
+}
+
+// revert rolls back apply(block). ledger.mutex must be held.
+func (ledger *Ledger) revert(block Block) {
+	hash := hex.EncodeToString(hashBlock(block))
+	for id, account := range ledger.undos[hash] {
+		ledger.accounts[id] = account
+	}
+	delete(ledger.undos, hash)
+}
+
+// switchChain moves the ledger from the main chain old to new: it rolls
+// back the blocks only old has and applies the ones only new has. If a
+// block of new can't be applied, the ledger is left at old and that block
+// is returned with the error.
+func (ledger *Ledger) switchChain(old []Block, new []Block) (Block, error) {
+	ledger.mutex.Lock()
+	defer ledger.mutex.Unlock()
+	fork := forkIndex(old, new)
+	for i := len(old) - 1; i >= fork; i-- {
+		ledger.revert(old[i])
+	}
+	for i := fork; i < len(new); i++ {
+		if err := ledger.apply(new[i]); err != nil {
+			for j := i - 1; j >= fork; j-- {
+				ledger.revert(new[j])
+			}
+			for j := fork; j < len(old); j++ {
+				ledger.apply(old[j])
+			}
+			return new[i], err
+		}
+	}
+	if fork < len(old) {
+		log.Printf("info: ledger rolled back %d blocks and applied %d",
+			len(old)-fork, len(new)-fork)
+	}
+	return Block{}, nil
+}
@@ -0,0 +1,136 @@
+package src
+
+import (
+	"encoding/hex"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var MAX_BLOCK_TXS = 100 // transactions a new block takes from the mempool at most
+
+// Mempool holds the transactions waiting to get into a block
+type Mempool struct {
+	mutex    sync.Mutex
+	txs      map[string]Transaction // pending, by hash
+	included map[string]bool        // already on the main chain
+	ledger   *Ledger                // the state new blocks are built on
+}
+
+func newMempool(ledger *Ledger) *Mempool {
+	return &Mempool{
+		txs:      map[string]Transaction{},
+		included: map[string]bool{},
+		ledger:   ledger,
+	}
+}
+
+// add puts tx into the pool, it reports false for invalid transactions and
+// for ones we already know
+func (pool *Mempool) add(tx Transaction) bool {
+	if !isTransactionValid(tx) {
+		log.Printf("warn: transaction from %s has invalid signature", tx.Sender)
+		return false
+	}
+	if tx.Nonce <= pool.ledger.account(tx.Sender).Nonce {
+		return false
+	}
+	hash := hex.EncodeToString(hashTransaction(tx))
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if _, ok := pool.txs[hash]; ok || pool.included[hash] {
+		return false
+	}
+	pool.txs[hash] = tx
+	return true
+}
+
+// all returns every pending transaction, highest fee first
+func (pool *Mempool) all() []Transaction {
+	pool.mutex.Lock()
+	txs := []Transaction{}
+	for _, tx := range pool.txs {
+		txs = append(txs, tx)
+	}
+	pool.mutex.Unlock()
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].Fee != txs[j].Fee {
+			return txs[i].Fee > txs[j].Fee
+		}
+		if txs[i].Sender != txs[j].Sender {
+			return txs[i].Sender < txs[j].Sender
+		}
+		return txs[i].Nonce < txs[j].Nonce
+	})
+	return txs
+}
+
+// pending returns up to limit transactions that can go into the next block
+// in this order. Each sender's transactions have to follow its nonces, so
+// we repeatedly take the next transaction of the sender offering the
+// highest fee for it, and skip what the ledger wouldn't accept.
+func (pool *Mempool) pending(limit int) []Transaction {
+	bySender := map[peer.ID][]Transaction{}
+	for _, tx := range pool.all() {
+		bySender[tx.Sender] = append(bySender[tx.Sender], tx)
+	}
+	for _, txs := range bySender {
+		sort.SliceStable(txs, func(i, j int) bool { return txs[i].Nonce < txs[j].Nonce })
+	}
+
+	pool.ledger.mutex.Lock()
+	defer pool.ledger.mutex.Unlock()
+	accounts := map[peer.ID]Account{}
+	selected := []Transaction{}
+	for len(selected) < limit && len(bySender) > 0 {
+		var best peer.ID
+		for sender, txs := range bySender {
+			if best == "" || txs[0].Fee > bySender[best][0].Fee ||
+				(txs[0].Fee == bySender[best][0].Fee && sender < best) {
+				best = sender
+			}
+		}
+		tx := bySender[best][0]
+		if bySender[best] = bySender[best][1:]; len(bySender[best]) == 0 {
+			delete(bySender, best)
+		}
+		if err := pool.ledger.applyTx(accounts, tx); err == nil {
+			selected = append(selected, tx)
+		} else if tx.Nonce > pool.ledger.load(accounts, best).Nonce {
+			// the sender can't go on until this one is fixed
+			delete(bySender, best)
+		}
+	}
+	return selected
+}
+
+func (pool *Mempool) size() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return len(pool.txs)
+}
+
+// update follows the main chain switching from old to new: transactions of
+// blocks that left the main chain are pending again, the ones of blocks
+// that joined it are removed
+func (pool *Mempool) update(old []Block, new []Block) {
+	fork := forkIndex(old, new)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, block := range old[fork:] {
+		for _, tx := range block.Transactions {
+			hash := hex.EncodeToString(hashTransaction(tx))
+			delete(pool.included, hash)
+			pool.txs[hash] = tx
+		}
+	}
+	for _, block := range new[fork:] {
+		for _, tx := range block.Transactions {
+			hash := hex.EncodeToString(hashTransaction(tx))
+			delete(pool.txs, hash)
+			pool.included[hash] = true
+		}
+	}
+}
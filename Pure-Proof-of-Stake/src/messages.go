@@ -0,0 +1,368 @@
+package src
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	MESSAGE_ROUNDS     = 4     // rounds behind and ahead of the next one messages are kept for
+	MAX_ROUND_MESSAGES = 10000 // messages kept per round at most, parked ones included
+)
+
+// MESSAGE_STORE holds the BA* messages of the rounds in progress
+var MESSAGE_STORE = newMessageStore()
+
+// messageKey identifies a message: a sender gets one per step of a round,
+// proposals are step 1
+type messageKey struct {
+	round  int
+	step   int
+	sender peer.ID
+}
+
+// parkedMessage came in before its round started, it is verified once the
+// round does
+type parkedMessage struct {
+	message interface{} // Message, Message23 or Message4
+	from    peer.ID
+}
+
+// roundMessages are the messages of a round, in the order they came in
+type roundMessages struct {
+	proposals []Message
+	votes23   []Message23 // steps 2 and 3
+	votes4    []Message4  // steps 4 and later
+	seen      map[messageKey]bool
+	parked    []parkedMessage
+	parkedIDs map[string]bool // by hash, so that a copy isn't parked twice
+}
+
+// MessageStore keeps the verified BA* messages by round, step and sender.
+// A sender's first message for a step is kept, later ones are dropped.
+// Rounds below the finalized height and more than MESSAGE_ROUNDS behind
+// the next one are collected, rounds more than MESSAGE_ROUNDS ahead aren't
+// accepted, and no round holds more than MAX_ROUND_MESSAGES messages.
+type MessageStore struct {
+	mutex  sync.Mutex
+	rounds map[int]*roundMessages
+	floor  int // rounds below are collected
+	next   int // the round following the tip
+}
+
+// RoundSnapshot counts the messages of a round
+type RoundSnapshot struct {
+	Round     int         `json:"round"`
+	Proposals int         `json:"proposals"`
+	Votes     map[int]int `json:"votes"` // messages by step
+	Parked    int         `json:"parked"`
+}
+
+// RoundMessages is a copy of the messages of a round
+type RoundMessages struct {
+	Round     int         `json:"round"`
+	Proposals []Message   `json:"proposals"`
+	Votes23   []Message23 `json:"votes23"`
+	Votes4    []Message4  `json:"votes4"`
+	Parked    int         `json:"parked"`
+}
+
+func newMessageStore() *MessageStore {
+	return &MessageStore{rounds: map[int]*roundMessages{}}
+}
+
+// round returns the messages of round, nil if it isn't accepted or is
+// full. store.mutex must be held.
+func (store *MessageStore) round(round int) *roundMessages {
+	if round < store.floor || round > store.next+MESSAGE_ROUNDS {
+		return nil
+	}
+	r, isKept := store.rounds[round]
+	if !isKept {
+		r = &roundMessages{seen: map[messageKey]bool{}, parkedIDs: map[string]bool{}}
+		store.rounds[round] = r
+	}
+	if len(r.proposals)+len(r.votes23)+len(r.votes4)+len(r.parked) >= MAX_ROUND_MESSAGES {
+		return nil
+	}
+	return r
+}
+
+// isNew marks key as seen and reports whether it wasn't before.
+// store.mutex must be held.
+func (r *roundMessages) isNew(key messageKey) bool {
+	if r.seen[key] {
+		return false
+	}
+	r.seen[key] = true
+	return true
+}
+
+// addProposal stores a verified proposal, it reports false for one that
+// is out of bounds or from a sender we already have one of
+func (store *MessageStore) addProposal(m Message) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r := store.round(m.Block.Round)
+	if r == nil || !r.isNew(messageKey{m.Block.Round, 1, m.Sign.PeerID}) {
+		return false
+	}
+	r.proposals = append(r.proposals, m)
+	return true
+}
+
+// addVote23 stores a verified vote of step 2 or 3, see addProposal
+func (store *MessageStore) addVote23(m Message23) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r := store.round(m.Sign.Seed.Round)
+	if r == nil || !r.isNew(messageKey{m.Sign.Seed.Round, m.Sign.Seed.Step, m.PeerID}) {
+		return false
+	}
+	r.votes23 = append(r.votes23, m)
+	return true
+}
+
+// addVote4 stores a verified vote of step 4 or later, see addProposal
+func (store *MessageStore) addVote4(m Message4) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r := store.round(m.Sign.Seed.Round)
+	if r == nil || !r.isNew(messageKey{m.Sign.Seed.Round, m.Sign.Seed.Step, m.PeerID}) {
+		return false
+	}
+	r.votes4 = append(r.votes4, m)
+	return true
+}
+
+// park keeps a message of a round that hasn't started yet. Parked
+// messages aren't verified, so they aren't deduplicated by sender, which
+// anyone could claim to be, only copies are dropped.
+func (store *MessageStore) park(round int, message interface{}, from peer.ID) bool {
+	j, err := json.Marshal(message)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(j)
+	id := hex.EncodeToString(hash[:])
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r := store.round(round)
+	if r == nil || r.parkedIDs[id] {
+		return false
+	}
+	r.parkedIDs[id] = true
+	r.parked = append(r.parked, parkedMessage{message, from})
+	return true
+}
+
+// unpark returns and forgets the messages parked for round
+func (store *MessageStore) unpark(round int) []parkedMessage {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r, isKept := store.rounds[round]
+	if !isKept {
+		return nil
+	}
+	parked := r.parked
+	r.parked, r.parkedIDs = nil, map[string]bool{}
+	return parked
+}
+
+func (store *MessageStore) proposals(round int) []Message {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if r, isKept := store.rounds[round]; isKept {
+		return append([]Message{}, r.proposals...)
+	}
+	return nil
+}
+
+// A round is run again while the tip doesn't move on, but our
+// participation key of a step is deleted once we signed with it and peers
+// keep the first message of a sender for a step anyway. So the message we
+// sent for a step the first time is sent again, see ownProposal, ownVote23
+// and ownVote4.
+
+// ownProposal returns the proposal we sent in round, if any
+func (store *MessageStore) ownProposal(round int) (Message, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if r, isKept := store.rounds[round]; isKept {
+		for _, m := range r.proposals {
+			if m.Sign.PeerID == PEER_ID {
+				return m, true
+			}
+		}
+	}
+	return Message{}, false
+}
+
+// ownVote23 returns the vote we sent for step of round, step being 2 or 3
+func (store *MessageStore) ownVote23(round int, step int) (Message23, bool) {
+	for _, m := range store.votes23(round, step) {
+		if m.PeerID == PEER_ID {
+			return m, true
+		}
+	}
+	return Message23{}, false
+}
+
+// ownVote4 returns the vote we sent for step of round, step being 4 or
+// later
+func (store *MessageStore) ownVote4(round int, step int) (Message4, bool) {
+	for _, m := range store.votes4(round) {
+		if m.PeerID == PEER_ID && m.Sign.Seed.Step == step {
+			return m, true
+		}
+	}
+	return Message4{}, false
+}
+
+// votes23 returns the votes of step of round, step being 2 or 3
+func (store *MessageStore) votes23(round int, step int) []Message23 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	votes := []Message23{}
+	if r, isKept := store.rounds[round]; isKept {
+		for _, m := range r.votes23 {
+			if m.Sign.Seed.Step == step {
+				votes = append(votes, m)
+			}
+		}
+	}
+	return votes
+}
+
+// votes4 returns the votes of round from step 4 on
+func (store *MessageStore) votes4(round int) []Message4 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if r, isKept := store.rounds[round]; isKept {
+		return append([]Message4{}, r.votes4...)
+	}
+	return nil
+}
+
+// gc collects the rounds below finalized, the round of the latest block
+// with final consensus, and the ones more than MESSAGE_ROUNDS behind next
+func (store *MessageStore) gc(finalized int, next int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.next, store.floor = next, finalized
+	if next-MESSAGE_ROUNDS > store.floor {
+		store.floor = next - MESSAGE_ROUNDS
+	}
+	for round := range store.rounds {
+		if round < store.floor {
+			delete(store.rounds, round)
+		}
+	}
+}
+
+// snapshot counts the messages of every round kept, oldest first
+func (store *MessageStore) snapshot() []RoundSnapshot {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	snapshots := []RoundSnapshot{}
+	for round, r := range store.rounds {
+		votes := map[int]int{}
+		for _, m := range r.votes23 {
+			votes[m.Sign.Seed.Step]++
+		}
+		for _, m := range r.votes4 {
+			votes[m.Sign.Seed.Step]++
+		}
+		snapshots = append(snapshots, RoundSnapshot{round, len(r.proposals), votes, len(r.parked)})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Round < snapshots[j].Round })
+	return snapshots
+}
+
+// inspect returns a copy of the messages of round
+func (store *MessageStore) inspect(round int) (RoundMessages, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	r, isKept := store.rounds[round]
+	if !isKept {
+		return RoundMessages{}, false
+	}
+	return RoundMessages{
+		round,
+		append([]Message{}, r.proposals...),
+		append([]Message23{}, r.votes23...),
+		append([]Message4{}, r.votes4...),
+		len(r.parked),
+	}, true
+}
+
+// finalizedHeight is the round of the latest block of the main chain BA*
+// reached final consensus on, -1 if none. mutex must be held.
+func (app *App) finalizedHeight() int {
+	for i := len(app.Blocks) - 1; i > 0; i-- {
+		if CONSENSUS[app.Blocks[i].Round] == "final" {
+			return app.Blocks[i].Round
+		}
+	}
+	return -1
+}
+
+// receiveMessage verifies a BA* message from a peer and stores it. A
+// message of a round that hasn't started yet can't be verified, it is
+// parked until the round starts.
+func (app *App) receiveMessage(message interface{}, from peer.ID) {
+	var round int
+	var kind string
+	switch m := message.(type) {
+	case Message:
+		round, kind = m.Block.Round, "message"
+	case Message23:
+		round, kind = m.Sign.Seed.Round, fmt.Sprintf("message%d", m.Sign.Seed.Step)
+	case Message4:
+		round, kind = m.Sign.Seed.Round, "message4"
+	}
+	mutex.Lock()
+	next := len(app.Blocks) - 1
+	mutex.Unlock()
+	if round > next {
+		if !MESSAGE_STORE.park(round, message, from) {
+			dropMessage(kind, from, errStore)
+		}
+		return
+	}
+	var err error
+	switch m := message.(type) {
+	case Message:
+		if err = app.checkProposal(m); err == nil && !MESSAGE_STORE.addProposal(m) {
+			err = errStore
+		}
+	case Message23:
+		if err = app.checkMessage23(m); err == nil && !MESSAGE_STORE.addVote23(m) {
+			err = errStore
+		}
+	case Message4:
+		if err = app.checkMessage4(m); err == nil && !MESSAGE_STORE.addVote4(m) {
+			err = errStore
+		}
+	}
+	if err != nil {
+		dropMessage(kind, from, err)
+	}
+}
+
+// admitParked verifies and stores the messages parked for the round
+// following the tip, now that it has started
+func (app *App) admitParked() {
+	mutex.Lock()
+	next := len(app.Blocks) - 1
+	mutex.Unlock()
+	for _, p := range MESSAGE_STORE.unpark(next) {
+		app.receiveMessage(p.message, p.from)
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -22,17 +27,14 @@ type Keys struct {
 	pubKey  crypto.PubKey
 }
 
-var ( // immutable
+var ( // immutable once LoadKey has run
 	PRIV, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	privKey, pubKey, _ = crypto.ECDSAKeyPairFromKey(PRIV)
 	PEER_ID, _         = peer.IDFromPublicKey(pubKey)
 	KEYS = Keys{privKey, pubKey}
 	READWRITERS = []*bufio.ReadWriter{}
-	MESSAGES = []Message{}
-	MESSAGES2 = []Message23{}
-	MESSAGES3 = []Message23{}
-	MESSAGES4 = []Message4{}
 	mutex = &sync.Mutex{}
+	rwMutex = &sync.Mutex{} // guards READWRITERS and writes to them
 )
 
 type ChainResponse struct {
@@ -41,6 +43,11 @@ type ChainResponse struct {
 	Receiver peer.ID `json:"receiver"`
 }
 
+type TransactionRequest struct {
+	Transaction Transaction `json:"transaction"`
+	FromPeerId  peer.ID     `json:"from_peer_id"`
+}
+
 type LocalChainRequest struct {
 	ToPeerId   peer.ID `json:"to_peer_id"`
 	FromPeerId peer.ID `json:"from_peer_id"`
@@ -70,11 +77,61 @@ func (keys Keys) PrivKey() crypto.PrivKey {
 	return keys.privKey
 }
 
+// LoadKey makes the P-256 key in the PEM file filename our key, so that
+// our peer id, and with it our stake, outlives a restart. A missing file
+// is created with the key we have.
+func LoadKey(filename string) error {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		der, err := x509.MarshalECPrivateKey(PRIV)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	} else if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s is not a PEM file", filename)
+	}
+	priv, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if priv.Curve != elliptic.P256() {
+		return fmt.Errorf("%s is not a P-256 key", filename)
+	}
+	newPrivKey, newPubKey, err := crypto.ECDSAKeyPairFromKey(priv)
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPublicKey(newPubKey)
+	if err != nil {
+		return err
+	}
+	PRIV, privKey, pubKey, PEER_ID = priv, newPrivKey, newPubKey, id
+	KEYS = Keys{privKey, pubKey}
+	return nil
+}
+
+// AddReadWriter adds the stream of a new peer to the ones Publish writes to
+func AddReadWriter(rw *bufio.ReadWriter) {
+	rwMutex.Lock()
+	defer rwMutex.Unlock()
+	READWRITERS = append(READWRITERS, rw)
+}
+
+// Publish writes data to every peer. Transactions are gossiped by the
+// goroutines reading peers while BA* publishes its messages, so a message
+// is written and flushed as a whole before the next.
 func Publish(data interface{}) {
 	j, err := json.Marshal(data)
 	if err != nil {
 		log.Printf("warn: can jsonify")
 	}
+	rwMutex.Lock()
+	defer rwMutex.Unlock()
 	for _, rw := range READWRITERS {
 		rw.Write(append(j, '\n'))
 		rw.Flush()
@@ -91,6 +148,7 @@ func (app *App) InjectEvent(rw *bufio.ReadWriter) {
 		var (
 			respChain     ChainResponse
 			respBlock     BlockRequest
+			respTx        TransactionRequest
 			respMessage   MessageRequest
 			respMessage23 Message23Request
 			respMessage4  Message4Request
@@ -98,8 +156,10 @@ func (app *App) InjectEvent(rw *bufio.ReadWriter) {
 		if json.Unmarshal(msg, &respChain);
 				respChain.Receiver != "" && respChain.Receiver == PEER_ID {
 			log.Printf("info: Response from %s", respChain.Sender)
-			app.Blocks = app.chooseChain(
-				app.Blocks, respChain.Blocks)
+			app.syncChain(respChain.Blocks)
+		} else if json.Unmarshal(msg, &respTx);
+				respTx.Transaction.Sender != "" && respTx.FromPeerId != "" {
+			app.submitTransaction(respTx.Transaction)
 		} else if json.Unmarshal(msg, &respBlock);
 				respBlock.Block.SSeed.PeerID != "" &&
 				respBlock.Block.SSeed.PeerID == respBlock.FromPeerId {
@@ -110,31 +170,23 @@ func (app *App) InjectEvent(rw *bufio.ReadWriter) {
 				respMessage23.Message.PeerID == respMessage23.FromPeerId &&
 				respMessage23.Message.Sign.Seed.Step == 2 {
 			log.Printf("info: received new message2 from %s", respMessage23.FromPeerId)
-			mutex.Lock()
-			MESSAGES2 = append(MESSAGES2, respMessage23.Message)
-			mutex.Unlock()
+			app.receiveMessage(respMessage23.Message, respMessage23.FromPeerId)
 		} else if respMessage23.Message.PeerID != "" &&
 				respMessage23.Message.PeerID == respMessage23.FromPeerId &&
 				respMessage23.Message.Sign.Seed.Step == 3 {
 			log.Printf("info: received new message3 from %s", respMessage23.FromPeerId)
-			mutex.Lock()
-			MESSAGES3 = append(MESSAGES3, respMessage23.Message)
-			mutex.Unlock()
+			app.receiveMessage(respMessage23.Message, respMessage23.FromPeerId)
 		} else if json.Unmarshal(msg, &respMessage4);
 				respMessage4.Message.PeerID != "" &&
 				respMessage4.Message.PeerID == respMessage4.FromPeerId {
 			log.Printf("info: recieved new message%d from %s",
 				respMessage4.Message.Sign.Seed.Step, respMessage4.FromPeerId)
-			mutex.Lock()
-			MESSAGES4 = append(MESSAGES4, respMessage4.Message)
-			mutex.Unlock()
+			app.receiveMessage(respMessage4.Message, respMessage4.FromPeerId)
 		} else if json.Unmarshal(msg, &respMessage);
 				respMessage.Message.Sign.PeerID != "" &&
 				respMessage.Message.Sign.PeerID == respMessage.FromPeerId {
 			log.Printf("info: received new message from %s", respMessage.FromPeerId)
-			mutex.Lock()
-			MESSAGES = append(MESSAGES, respMessage.Message)
-			mutex.Unlock()
+			app.receiveMessage(respMessage.Message, respMessage.FromPeerId)
 		}
 	}
 }
@@ -164,27 +216,257 @@ func HandlePrintChains(app *App) {
 		log.Printf("warn: can indent json")
 	}
 	log.Printf("info: %s", out.String())
+
+	for i, block := range app.Blocks {
+		interval := "-"
+		if i > 0 {
+			interval = (time.Duration(block.Timestamp-app.Blocks[i-1].Timestamp) *
+				time.Millisecond).String()
+		}
+		log.Printf("info: round: %d, timestamp: %s, interval: %s",
+			block.Round,
+			time.UnixMilli(block.Timestamp).Format(time.RFC3339Nano),
+			interval)
+	}
+}
+
+func HandlePrintForks(app *App) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	log.Printf("info: Branches:")
+	for _, leaf := range app.Tree.leaves() {
+		log.Printf("info: tip: %s, round: %d, weight: %s, main: %t",
+			leaf.hash,
+			leaf.block.Round,
+			leaf.weight,
+			leaf == app.Tree.tip)
+	}
+	log.Printf("info: orphans: %d", len(app.Tree.orphans))
+	j, err := json.Marshal(app.Reorgs)
+	if err != nil {
+		log.Printf("warn: can jsonify reorgs")
+	}
+	log.Printf("info: reorgs: %s", j)
+}
+
+// submitTransaction adds tx to the mempool and passes it on to our peers
+// if we haven't seen it before
+func (app *App) submitTransaction(tx Transaction) {
+	if app.Mempool.add(tx) {
+		log.Printf("info: new transaction from %s, pending: %d", tx.Sender, app.Mempool.size())
+		Publish(TransactionRequest{tx, PEER_ID})
+	}
+}
+
+// createTransaction creates a transaction from us that follows the last
+// one we sent, including the ones still in the mempool
+func (app *App) createTransaction(recipient peer.ID, payload string, amount int, fee int) Transaction {
+	nonce := app.Ledger.account(PEER_ID).Nonce
+	for _, tx := range app.Mempool.all() {
+		if tx.Sender == PEER_ID && tx.Nonce > nonce {
+			nonce = tx.Nonce
+		}
+	}
+	return newTransaction(recipient, payload, amount, fee, nonce+1)
+}
+
+func HandleSendTransaction(cmd string, app *App) {
+	args := strings.SplitN(strings.TrimPrefix(cmd, "send tx "), " ", 4)
+	if len(args) < 3 {
+		log.Printf("error: usage: send tx <recipient> <amount> <fee> [payload]")
+		return
+	}
+	recipient, err := peer.Decode(args[0])
+	if err != nil {
+		log.Printf("error: invalid recipient")
+		return
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount < 0 {
+		log.Printf("error: invalid amount")
+		return
+	}
+	fee, err := strconv.Atoi(args[2])
+	if err != nil || fee < 0 {
+		log.Printf("error: invalid fee")
+		return
+	}
+	payload := ""
+	if len(args) == 4 {
+		payload = args[3]
+	}
+	app.submitTransaction(app.createTransaction(recipient, payload, amount, fee))
+}
+
+func HandleBalance(cmd string, app *App) {
+	id := PEER_ID
+	if arg := strings.TrimPrefix(strings.TrimPrefix(cmd, "balance"), " "); arg != "" {
+		var err error
+		if id, err = peer.Decode(arg); err != nil {
+			log.Printf("error: invalid peer id")
+			return
+		}
+	}
+	account := app.Ledger.account(id)
+	log.Printf("info: %s balance: %d, nonce: %d", id, account.Balance, account.Nonce)
+}
+
+func HandlePrintMempool(app *App) {
+	log.Printf("info: Mempool:")
+	j, err := json.Marshal(app.Mempool.all())
+	if err != nil {
+		log.Printf("warn: can jsonify transactions")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, j, "", "  "); err != nil {
+		log.Printf("warn: can indent json")
+	}
+	log.Printf("info: %s", out.String())
 }
 
+// HandleCreateBlock proposes a block filled from the mempool, the data of
+// "create b <data>" is put into the mempool first
 func HandleCreateBlock(cmd string, app *App) {
-	data := strings.TrimPrefix(cmd, "create b ")
-	if data == "" {
-		log.Printf("error: invalid command")
-	} else {
-		latestBlock := app.Blocks[len(app.Blocks)-1]
-		j, _ := json.Marshal(latestBlock)
-		hash := sha256.Sum256(j)
-		block, isCast := newBlock(
-			latestBlock.Round+1,
-			hash[:],
-			app.Seed,
-			data)
-		if isCast {
-			log.Printf("info: broadcast new block")
-			Publish(BlockRequest{block, PEER_ID})
-			app.tryAddBlock(block)
-		} else {
-			log.Printf("info: you are not a leader")
+	if data := strings.TrimPrefix(cmd, "create b"); data != "" {
+		app.submitTransaction(app.createTransaction(PEER_ID, strings.TrimPrefix(data, " "), 0, 0))
+	}
+	app.proposeNext()
+}
+
+// proposeNext runs one round of consensus on top of the current tip and,
+// if we are the leader, publishes and adds the block
+func (app *App) proposeNext() (Block, bool) {
+	mutex.Lock()
+	latestBlock, seed := app.Blocks[len(app.Blocks)-1], app.Seed
+	stake, _ := app.stakeFor(latestBlock.Round + 1)
+	mutex.Unlock()
+	app.renewParticipation(latestBlock.Round+1, stake)
+	block, isCast := newBlock(
+		latestBlock.Round+1,
+		hashBlock(latestBlock),
+		seed,
+		stake,
+		app.Mempool)
+	if !isCast {
+		log.Printf("info: you are not a leader")
+		return Block{}, false
+	}
+	log.Printf("info: broadcast new block")
+	Publish(BlockRequest{block, PEER_ID})
+	app.tryAddBlock(block)
+	return block, true
+}
+
+// HandleBench runs "bench <blocks|duration> [file]", the result is logged
+// as JSON and appended to file if given
+func HandleBench(cmd string, app *App) {
+	args := strings.Fields(strings.TrimPrefix(cmd, "bench"))
+	if len(args) < 1 || len(args) > 2 {
+		log.Printf("error: usage: bench <blocks|duration> [file]")
+		return
+	}
+	blocks, duration, isValid := parseBenchLimit(args[0])
+	if !isValid {
+		log.Printf("error: invalid number of blocks or duration")
+		return
+	}
+	file := ""
+	if len(args) == 2 {
+		file = args[1]
+	}
+	logBenchResult(app.bench(blocks, duration), file)
+}
+
+// HandlePrintTimes prints the summary of the intervals between added
+// blocks
+func HandlePrintTimes(app *App) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	j, err := json.Marshal(app.Times.stats())
+	if err != nil {
+		log.Printf("warn: can jsonify block times")
+	}
+	log.Printf("info: block times: %s", j)
+}
+
+// HandleExportTimes writes the block times for "export times <file>" as
+// CSV if file ends in .csv, as JSON lines otherwise
+func HandleExportTimes(cmd string, app *App) {
+	filename := strings.TrimSpace(strings.TrimPrefix(cmd, "export times"))
+	if filename == "" {
+		log.Printf("error: usage: export times <file>")
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if err := app.Times.export(filename); err != nil {
+		log.Printf("error: can write %s", filename)
+		return
+	}
+	j, _ := json.Marshal(app.Times.stats())
+	log.Printf("info: exported block times to %s: %s", filename, j)
+}
+
+// HandlePrintMessages prints how many BA* messages every round kept has
+// for "ls messages", and the messages of round for "ls messages <round>"
+func HandlePrintMessages(cmd string) {
+	arg := strings.TrimSpace(strings.TrimPrefix(cmd, "ls messages"))
+	if arg == "" {
+		j, err := json.Marshal(MESSAGE_STORE.snapshot())
+		if err != nil {
+			log.Printf("warn: can jsonify messages")
 		}
+		log.Printf("info: messages: %s", j)
+		return
+	}
+	round, err := strconv.Atoi(arg)
+	if err != nil {
+		log.Printf("error: usage: ls messages [round]")
+		return
+	}
+	messages, isKept := MESSAGE_STORE.inspect(round)
+	if !isKept {
+		log.Printf("error: no messages of round %d", round)
+		return
+	}
+	j, err := json.Marshal(messages)
+	if err != nil {
+		log.Printf("warn: can jsonify messages")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, j, "", "  "); err != nil {
+		log.Printf("warn: can indent json")
+	}
+	log.Printf("info: %s", out.String())
+}
+
+// HandlePrintDropped prints how many BA* messages we dropped, by kind and
+// reason
+func HandlePrintDropped() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	j, err := json.Marshal(DROPPED)
+	if err != nil {
+		log.Printf("warn: can jsonify dropped messages")
+	}
+	log.Printf("info: dropped messages: %s", j)
+}
+
+// HandleStatus prints the status of the block "status <hash|round>" names
+func HandleStatus(cmd string, app *App) {
+	query := strings.TrimSpace(strings.TrimPrefix(cmd, "status"))
+	mutex.Lock()
+	status, isKnown := app.blockStatus(query)
+	mutex.Unlock()
+	if !isKnown {
+		log.Printf("error: unknown block %s", query)
+		return
+	}
+	j, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("warn: can jsonify block status")
 	}
+	log.Printf("info: status: %s", j)
 }
@@ -0,0 +1,343 @@
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var PARTICIPATION_ROUNDS = 100 // rounds a set of participation keys covers
+
+// Participation keys make the ephemeral signatures of BA* forward secure.
+// A node generates a key for every step of every round it will take part
+// in, registers the merkle root of their public keys in a transaction and
+// deletes each secret right after signing with it, so that a key stolen
+// later can't sign for a step that is over. Until a registration covering
+// the round is on the chain, ephemeral signatures fall back to the node
+// key.
+
+// Registration commits to a set of participation keys, one for each of
+// Steps steps of Rounds rounds starting at First
+type Registration struct {
+	First  int
+	Rounds int
+	Steps  int
+	Root   []byte
+}
+
+// PartKey is the participation key an ephemeral signature was made with
+// and its merkle path to the registered root, empty for the node key
+type PartKey struct {
+	Key  []byte   `json:"key"` // compressed P-256 point
+	Path [][]byte `json:"path"`
+}
+
+// participationKeys is a set of participation keys, the ones not used
+// yet and the merkle tree over all of them
+type participationKeys struct {
+	reg    Registration
+	keys   []*ecdsa.PrivateKey // nil once used or expired
+	levels [][][]byte          // leaves first
+}
+
+// Participation holds our sets of participation keys, the registered one
+// and the one registered next
+type Participation struct {
+	mutex      sync.Mutex
+	sets       []*participationKeys
+	generating bool // a new set is being generated, see renewParticipation
+}
+
+var PARTICIPATION = &Participation{}
+
+func (reg Registration) covers(round int) bool {
+	return reg.First <= round && round < reg.First+reg.Rounds
+}
+
+func (reg Registration) index(round int, step int) int {
+	return (round-reg.First)*reg.Steps + step - 1
+}
+
+func registrationPayload(reg Registration) string {
+	return fmt.Sprintf("register %d %d %d %x", reg.First, reg.Rounds, reg.Steps, reg.Root)
+}
+
+// parseRegistration reads the registration a transaction payload holds
+func parseRegistration(payload string) (Registration, bool) {
+	var reg Registration
+	var root string
+	if _, err := fmt.Sscanf(payload, "register %d %d %d %s", &reg.First, &reg.Rounds, &reg.Steps, &root); err != nil {
+		return Registration{}, false
+	}
+	var err error
+	if reg.Root, err = hex.DecodeString(root); err != nil || len(reg.Root) != sha256.Size ||
+		reg.Rounds <= 0 || reg.Steps <= 0 {
+		return Registration{}, false
+	}
+	return reg, true
+}
+
+// partKeyLeaf binds a participation key to its round and step
+func partKeyLeaf(round int, step int, key []byte) []byte {
+	buf := appendInt(appendInt([]byte{ENCODING_VERSION}, round), step)
+	hash := sha256.Sum256(appendBytes(buf, key))
+	return hash[:]
+}
+
+func hashPair(a []byte, b []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, a...), b...))
+	return hash[:]
+}
+
+// newParticipationKeys generates keys for rounds rounds starting at first
+func newParticipationKeys(first int, rounds int) *participationKeys {
+	set := &participationKeys{reg: Registration{first, rounds, maxStep - 1, nil}}
+	leaves := [][]byte{}
+	for round := first; round < first+rounds; round++ {
+		for step := 1; step < maxStep; step++ {
+			priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			set.keys = append(set.keys, priv)
+			leaves = append(leaves, partKeyLeaf(round, step, elliptic.MarshalCompressed(priv.Curve, priv.X, priv.Y)))
+		}
+	}
+	// the last hash of an odd level is paired with itself, as in merkleRoot
+	set.levels = [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			j := i + 1
+			if j == len(level) {
+				j = i
+			}
+			next = append(next, hashPair(level[i], level[j]))
+		}
+		set.levels = append(set.levels, next)
+		level = next
+	}
+	set.reg.Root = set.levels[len(set.levels)-1][0]
+	return set
+}
+
+// path returns the merkle path of the leaf i
+func (set *participationKeys) path(i int) [][]byte {
+	path := [][]byte{}
+	for _, level := range set.levels[:len(set.levels)-1] {
+		sibling := i ^ 1
+		if sibling == len(level) {
+			sibling = i
+		}
+		path = append(path, level[sibling])
+		i /= 2
+	}
+	return path
+}
+
+// isPartKeyValid checks that the participation key of round and step is
+// part of the set reg commits to
+func isPartKeyValid(reg Registration, round int, step int, partKey PartKey) bool {
+	if !reg.covers(round) || step < 1 || step > reg.Steps {
+		return false
+	}
+	i, hash := reg.index(round, step), partKeyLeaf(round, step, partKey.Key)
+	for _, sibling := range partKey.Path {
+		if i%2 == 0 {
+			hash = hashPair(hash, sibling)
+		} else {
+			hash = hashPair(sibling, hash)
+		}
+		i /= 2
+	}
+	return i == 0 && bytes.Equal(hash, reg.Root)
+}
+
+// add keeps a new set of keys, dropping the sets it supersedes but the
+// registered one
+func (p *Participation) add(set *participationKeys, registered Registration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	sets := []*participationKeys{set}
+	for _, s := range p.sets {
+		if bytes.Equal(s.reg.Root, registered.Root) {
+			sets = append(sets, s)
+		}
+	}
+	p.sets = sets
+}
+
+// startGenerating reports whether we may generate a new set of keys, that
+// is we aren't already, see doneGenerating
+func (p *Participation) startGenerating() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.generating {
+		return false
+	}
+	p.generating = true
+	return true
+}
+
+// doneGenerating is called once the new set is added and its registration
+// submitted to the mempool
+func (p *Participation) doneGenerating() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.generating = false
+}
+
+// has tells whether we hold the keys reg commits to
+func (p *Participation) has(reg Registration) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, set := range p.sets {
+		if bytes.Equal(set.reg.Root, reg.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+// take returns our key registered as reg for step of round and deletes
+// it, together with every key of the rounds before
+func (p *Participation) take(reg Registration, round int, step int) *ecdsa.PrivateKey {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, set := range p.sets {
+		if !bytes.Equal(set.reg.Root, reg.Root) {
+			continue
+		}
+		for i := 0; i < set.reg.index(round, 1) && i < len(set.keys); i++ {
+			if set.keys[i] != nil {
+				set.keys[i].D.SetInt64(0)
+				set.keys[i] = nil
+			}
+		}
+		i := set.reg.index(round, step)
+		if i < 0 || i >= len(set.keys) {
+			return nil
+		}
+		priv := set.keys[i]
+		set.keys[i] = nil
+		return priv
+	}
+	return nil
+}
+
+// pathOf returns the path of our key for step of round registered as reg
+func (p *Participation) pathOf(reg Registration, round int, step int) [][]byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, set := range p.sets {
+		if bytes.Equal(set.reg.Root, reg.Root) {
+			return set.path(reg.index(round, step))
+		}
+	}
+	return nil
+}
+
+// ephemeralSign signs each of data for step of round, with our registered
+// participation key, which is deleted right after, or with our node key
+// if none is registered for round
+func ephemeralSign(stake StakeTable, round int, step int, data ...[]byte) (PartKey, [][]byte) {
+	signs := [][]byte{}
+	reg, isRegistered := stake.registration(PEER_ID)
+	if !isRegistered || !reg.covers(round) {
+		for _, d := range data {
+			signs = append(signs, signData(d))
+		}
+		return PartKey{}, signs
+	}
+	priv := PARTICIPATION.take(reg, round, step)
+	if priv == nil {
+		log.Printf("error: participation key for round %d step %d is gone", round, step)
+		return PartKey{}, [][]byte{}
+	}
+	for _, d := range data {
+		hash := sha256.Sum256(d)
+		sign, _ := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+		signs = append(signs, sign)
+	}
+	partKey := PartKey{elliptic.MarshalCompressed(priv.Curve, priv.X, priv.Y), PARTICIPATION.pathOf(reg, round, step)}
+	priv.D.SetInt64(0)
+	return partKey, signs
+}
+
+// isEphemeralValid checks the ephemeral signatures signs of data from id
+// for step of round, made with partKey if id registered a set of keys
+// covering round and with key, its node key, otherwise
+func isEphemeralValid(stake StakeTable, id peer.ID, key crypto.PubKey, round int, step int,
+	partKey PartKey, data [][]byte, signs [][]byte) bool {
+	if len(signs) != len(data) {
+		return false
+	}
+	reg, isRegistered := stake.registration(id)
+	if !isRegistered || !reg.covers(round) {
+		for i := range data {
+			if len(partKey.Key) > 0 || !isSignValid(key, data[i], signs[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if !isPartKeyValid(reg, round, step, partKey) {
+		return false
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), partKey.Key)
+	if x == nil {
+		return false
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	for i := range data {
+		hash := sha256.Sum256(data[i])
+		if !ecdsa.VerifyASN1(pub, hash[:], signs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// genesisRegistration registers our first set of participation keys in
+// the genesis block
+func genesisRegistration() Transaction {
+	set := newParticipationKeys(0, PARTICIPATION_ROUNDS)
+	PARTICIPATION.add(set, Registration{})
+	return newTransaction(PEER_ID, registrationPayload(set.reg), 0, 0, 0)
+}
+
+// renewParticipation generates and registers a new set of participation
+// keys starting at round, unless one on the main chain or in the mempool
+// still covers the next PARTICIPATION_ROUNDS/2 rounds and we hold its
+// keys, which we don't after a restart. The keys are generated in the
+// background, a set of PARTICIPATION_ROUNDS rounds takes a while, so that
+// the round goes on with the keys registered so far.
+func (app *App) renewParticipation(round int, stake StakeTable) {
+	ahead := round + PARTICIPATION_ROUNDS/2
+	if reg, isRegistered := stake.registration(PEER_ID); isRegistered && reg.covers(ahead) && PARTICIPATION.has(reg) {
+		return
+	}
+	for _, tx := range app.Mempool.all() {
+		if reg, isReg := parseRegistration(tx.Payload); isReg && tx.Sender == PEER_ID && reg.covers(ahead) &&
+			PARTICIPATION.has(reg) {
+			return
+		}
+	}
+	if !PARTICIPATION.startGenerating() {
+		return
+	}
+	registered, _ := stake.registration(PEER_ID)
+	go func() {
+		set := newParticipationKeys(round, PARTICIPATION_ROUNDS)
+		PARTICIPATION.add(set, registered)
+		log.Printf("info: registering participation keys for rounds %d to %d", round, round+PARTICIPATION_ROUNDS-1)
+		app.submitTransaction(app.createTransaction(PEER_ID, registrationPayload(set.reg), 0, 0))
+		PARTICIPATION.doneGenerating()
+	}()
+}
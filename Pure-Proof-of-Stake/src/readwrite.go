@@ -37,6 +37,20 @@ func CreateWriteLine(filename, addrName string) error {
     return nil
 }
 
+// AppendLine appends line to filename, creating the file if needed
+func AppendLine(filename, line string) error {
+    file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    if _, err := file.WriteString(line + "\n"); err != nil {
+        return err
+    }
+    return nil
+}
+
 func WriteLine(filename, addrName string) error {
     file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
     if err != nil {
@@ -0,0 +1,124 @@
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	PROPOSERS = 10 // proposers sortition selects per round on average
+	COMMITTEE = 20 // votes sortition selects per step on average
+)
+
+// Sortition is a lottery only its winners can prove they won. Every coin
+// of stake is a sub-user, and each is selected for a step of a round with
+// probability expected/total stake, so that expected sub-users are
+// selected on average. The output of the VRF of a node over the seed,
+// round and step picks how many of its sub-users are, following the
+// binomial distribution. Step 1 selects the proposers, every later step
+// its committee, where a member has a vote per selected sub-user.
+
+// Credential proves that PeerID was selected for a step with Votes
+// sub-users: Proof is a VRF proof over the seed, round and step under
+// PubKey, the key PeerID is derived from
+type Credential struct {
+	PubKey []byte `json:"public_key"`
+	Proof  []byte `json:"proof"`
+	Votes  int    `json:"votes"`
+}
+
+// binomial is the probability of k successes out of n with p each
+func binomial(k int, n int, p float64) float64 {
+	lgamma := func(x int) float64 {
+		v, _ := math.Lgamma(float64(x + 1))
+		return v
+	}
+	return math.Exp(lgamma(n) - lgamma(k) - lgamma(n-k) +
+		float64(k)*math.Log(p) + float64(n-k)*math.Log1p(-p))
+}
+
+// subUsers returns how many sub-users of stake the VRF output beta
+// selects when expected of total are selected on average: the j for which
+// beta, read as a fraction, falls between the binomial cdf at j-1 and j
+func subUsers(beta []byte, stake int, expected int, total int) int {
+	if stake <= 0 || total <= 0 {
+		return 0
+	}
+	p := float64(expected) / float64(total)
+	if p >= 1 {
+		return stake
+	}
+	x := float64(binary.BigEndian.Uint64(beta)>>11) / (1 << 53)
+	cdf := 0.0
+	for j := 0; j < stake; j++ {
+		if cdf += binomial(j, stake, p); x < cdf {
+			return j
+		}
+	}
+	return stake
+}
+
+// createCredential runs sortition for us in the step s names, expected
+// is the number of sub-users to select out of stake
+func createCredential(s Seed, expected int, stake StakeTable) (Credential, bool) {
+	pub, _ := crypto.MarshalPublicKey(pubKey)
+	beta, proof := vrfProve(PRIV, seedBytes(s))
+	votes := subUsers(beta, stake.of(PEER_ID), expected, stake.total)
+	return Credential{pub, proof, votes}, votes > 0
+}
+
+// verifyCredential checks that cred proves id was selected in the step s
+// names with the votes it claims and returns the output of its VRF
+func verifyCredential(id peer.ID, cred Credential, s Seed, expected int, stake StakeTable) ([]byte, bool) {
+	pub, isSender := senderKey(id, cred.PubKey)
+	if !isSender {
+		return nil, false
+	}
+	std, err := crypto.PubKeyToStdKey(pub)
+	if err != nil {
+		return nil, false
+	}
+	key, isECDSA := std.(*ecdsa.PublicKey)
+	if !isECDSA {
+		return nil, false
+	}
+	beta, isValid := vrfVerify(key, seedBytes(s), cred.Proof)
+	if !isValid || cred.Votes <= 0 || cred.Votes != subUsers(beta, stake.of(id), expected, stake.total) {
+		return nil, false
+	}
+	return beta, true
+}
+
+// priority is the lowest hash of the VRF output with the index of one of
+// the sub-users of a credential verified before, the proposal with the
+// lowest priority leads
+func priority(cred Credential) []byte {
+	if len(cred.Proof) != vrfProofLen {
+		return nil
+	}
+	beta := vrfOutput(cred.Proof[:vrfPtLen])
+	var lowest []byte
+	for i := 1; i <= cred.Votes; i++ {
+		hash := sha256.Sum256(appendInt(append([]byte{}, beta...), i))
+		if lowest == nil || bytes.Compare(hash[:], lowest) < 0 {
+			lowest = hash[:]
+		}
+	}
+	return lowest
+}
+
+// seedFor returns the seed of round, known once the block before it is on
+// the main chain. mutex must be held.
+func (app *App) seedFor(round int) (string, bool) {
+	// the block of round r is Blocks[r+1]
+	if round < 0 || round >= len(app.Blocks) {
+		return "", false
+	}
+	return seedAfter(app.Blocks[round]), true
+}
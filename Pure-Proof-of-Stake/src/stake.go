@@ -0,0 +1,129 @@
+package src
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+var (
+	GENESIS_STAKE      = 1000              // coins we get at genesis unless GENESIS_ALLOCATION is set
+	GENESIS_ALLOCATION = map[peer.ID]int{} // coins of every account at genesis
+)
+
+// The stake of an account is its balance: it starts from the allocation
+// in the genesis block and changes with transfers and block rewards.
+
+// ReadAllocation reads a genesis allocation from filename, a JSON object
+// from peer ids to coins
+func ReadAllocation(filename string) (map[peer.ID]int, error) {
+	j, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	allocation := map[peer.ID]int{}
+	if err := json.Unmarshal(j, &allocation); err != nil {
+		return nil, err
+	}
+	return allocation, nil
+}
+
+// genesisTransactions credits the genesis allocation, they are applied
+// as blockRewards of the genesis block rather than as transfers
+func genesisTransactions() []Transaction {
+	allocation := GENESIS_ALLOCATION
+	if len(allocation) == 0 {
+		allocation = map[peer.ID]int{PEER_ID: GENESIS_STAKE}
+	}
+	ids := []peer.ID{}
+	for id := range allocation {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	txs := []Transaction{}
+	for _, id := range ids {
+		txs = append(txs, newTransaction(id, "genesis!", allocation[id], 0, 0))
+	}
+	return txs
+}
+
+// StakeTable is the stake of every account at some point of the chain,
+// and the participation keys it registered. Every node of the block tree
+// keeps the table after its block, derived from the one of its parent,
+// so that looking the stakes up doesn't replay the chain.
+type StakeTable struct {
+	stakes map[peer.ID]int
+	total  int
+	regs   map[peer.ID]Registration
+}
+
+func newStakeTable() StakeTable {
+	return StakeTable{map[peer.ID]int{}, 0, map[peer.ID]Registration{}}
+}
+
+func (table StakeTable) of(id peer.ID) int {
+	return table.stakes[id]
+}
+
+func (table StakeTable) registration(id peer.ID) (Registration, bool) {
+	reg, isRegistered := table.regs[id]
+	return reg, isRegistered
+}
+
+// after returns the table after block, table being the one before it.
+// It moves the coins of block the way Ledger.apply does without checking
+// its transactions: a block the ledger can't apply is pruned before it
+// makes it onto the main chain, and with it the branch built on it.
+func (table StakeTable) after(block Block) StakeTable {
+	stakes := make(map[peer.ID]int, len(table.stakes)+1)
+	for id, stake := range table.stakes {
+		stakes[id] = stake
+	}
+	regs, isShared := table.regs, true
+	fees := 0
+	for _, tx := range block.Transactions {
+		// a registration replaces the ones before, the map is copied
+		// only for blocks that carry one
+		if reg, isReg := parseRegistration(tx.Payload); isReg && tx.Recipient == tx.Sender {
+			if isShared {
+				regs, isShared = make(map[peer.ID]Registration, len(table.regs)+1), false
+				for id, r := range table.regs {
+					regs[id] = r
+				}
+			}
+			regs[tx.Sender] = reg
+		}
+		if block.Round < 0 {
+			continue
+		}
+		stakes[tx.Sender] -= tx.Amount + tx.Fee
+		stakes[tx.Recipient] += tx.Amount
+		fees += tx.Fee
+	}
+	rewards := blockRewards(block)
+	rewards[blockProducer(block)] += fees
+	for id, reward := range rewards {
+		stakes[id] += reward
+	}
+	next := StakeTable{map[peer.ID]int{}, 0, regs}
+	for id, stake := range stakes {
+		if stake > 0 {
+			next.stakes[id] = stake
+			next.total += stake
+		}
+	}
+	return next
+}
+
+// stakeFor returns the stakes sortition draws from in round, those after
+// the block before it, and the participation keys registered by then.
+// Only the stakes of the round following the tip are at hand. mutex must
+// be held.
+func (app *App) stakeFor(round int) (StakeTable, bool) {
+	if round != len(app.Blocks)-1 {
+		return StakeTable{}, false
+	}
+	return app.Tree.tip.stake, true
+}
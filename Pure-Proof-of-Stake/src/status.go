@@ -0,0 +1,49 @@
+package src
+
+import (
+	"encoding/hex"
+	"strconv"
+)
+
+// BlockStatus tells how safe a block is. A block is pending while it or
+// its round isn't part of the tree yet, e.g. while it waits for its
+// parent, confirmed once it is on the main chain, and orphaned while it
+// is on a side branch. A confirmed block also tells the consensus BA*
+// reached in its round, see CONSENSUS, unknown if we didn't take part.
+type BlockStatus struct {
+	Hash          string `json:"hash,omitempty"`
+	Round         int    `json:"round"`
+	Status        string `json:"status"` // pending, confirmed or orphaned
+	Confirmations int    `json:"confirmations"`
+	Consensus     string `json:"consensus,omitempty"` // final, tentative or unknown
+}
+
+// blockStatus looks up the block query names, either a hash in hex or a
+// round of the main chain. mutex must be held.
+func (app *App) blockStatus(query string) (BlockStatus, bool) {
+	var node *treeNode
+	if hash, err := hex.DecodeString(query); err == nil && len(hash) == 32 {
+		if node = app.Tree.get(hash); node == nil {
+			if orphan, isOrphan := app.Tree.orphan(hash); isOrphan {
+				return BlockStatus{Hash: query, Round: orphan.Round, Status: "pending"}, true
+			}
+			return BlockStatus{}, false
+		}
+	} else if round, err := strconv.Atoi(query); err == nil && round >= -1 {
+		// the block of round r is Blocks[r+1]
+		if round+1 >= len(app.Blocks) {
+			return BlockStatus{Round: round, Status: "pending"}, true
+		}
+		node = app.Tree.get(hashBlock(app.Blocks[round+1]))
+	} else {
+		return BlockStatus{}, false
+	}
+	status := BlockStatus{Hash: node.hash, Round: node.block.Round, Status: "orphaned"}
+	if k := app.Tree.confirmations(node); k > 0 {
+		status.Status, status.Confirmations = "confirmed", k
+		if status.Consensus = CONSENSUS[status.Round]; status.Consensus == "" {
+			status.Consensus = "unknown"
+		}
+	}
+	return status, true
+}
@@ -0,0 +1,39 @@
+package src
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+var MAX_FUTURE_DRIFT = 2 * time.Minute // how far ahead of our clock a block may be dated
+
+// medianSpan is the number of blocks the median time past is taken over
+const medianSpan = 11
+
+// medianTimePast returns the median timestamp of the last medianSpan
+// blocks of chain
+func medianTimePast(chain []Block) int64 {
+	first := len(chain) - medianSpan
+	if first < 0 {
+		first = 0
+	}
+	times := []int64{}
+	for _, b := range chain[first:] {
+		times = append(times, b.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+func isTimestampValid(block Block, chain []Block) bool {
+	if mtp := medianTimePast(chain); block.Timestamp < mtp {
+		log.Printf("warn: block with id: %d is dated before the median time past", block.Round)
+		return false
+	}
+	if limit := time.Now().Add(MAX_FUTURE_DRIFT).UnixMilli(); block.Timestamp > limit {
+		log.Printf("warn: block with id: %d is dated too far in the future", block.Round)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package src
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+type Transaction struct {
+	Sender    peer.ID `json:"sender"`
+	Recipient peer.ID `json:"recipient"`
+	Payload   string  `json:"payload"`
+	Amount    int     `json:"amount"`
+	Fee       int     `json:"fee"`
+	Nonce     int     `json:"nonce"`
+	PubKey    []byte  `json:"public_key"` // the key Sender is derived from
+	Sign      []byte  `json:"signature"`
+}
+
+func hashTransaction(tx Transaction) []byte {
+	hash := sha256.Sum256(txBytes(tx))
+	return hash[:]
+}
+
+// newTransaction creates a transaction from us to recipient and signs it
+func newTransaction(recipient peer.ID, payload string, amount int, fee int, nonce int) Transaction {
+	pub, _ := crypto.MarshalPublicKey(pubKey)
+	tx := Transaction{
+		PEER_ID,
+		recipient,
+		payload,
+		amount,
+		fee,
+		nonce,
+		pub,
+		nil,
+	}
+	hash := sha256.Sum256(txBytes(tx))
+	tx.Sign, _ = ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
+	return tx
+}
+
+// isTransactionValid checks that tx is signed by the key its Sender is
+// derived from
+func isTransactionValid(tx Transaction) bool {
+	pub, err := crypto.UnmarshalPublicKey(tx.PubKey)
+	if err != nil {
+		return false
+	}
+	if id, err := peer.IDFromPublicKey(pub); err != nil || id != tx.Sender {
+		return false
+	}
+	isValid, err := pub.Verify(txBytes(tx), tx.Sign)
+	return err == nil && isValid
+}
+
+// merkleRoot commits to txs the way Bitcoin does: the transaction hashes
+// are hashed pairwise up to a single root, the last hash of an odd level
+// is paired with itself. The root of no transactions is all zero.
+func merkleRoot(txs []Transaction) []byte {
+	if len(txs) == 0 {
+		return make([]byte, sha256.Size)
+	}
+	level := [][]byte{}
+	for _, tx := range txs {
+		level = append(level, hashTransaction(tx))
+	}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+	}
+	return level[0]
+}
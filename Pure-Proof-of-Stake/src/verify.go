@@ -0,0 +1,150 @@
+package src
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// DROPPED counts the BA* messages we dropped, by kind and reason
+var DROPPED = map[string]int{}
+
+var (
+	errCredential = errors.New("invalid credential")
+	errSignature  = errors.New("invalid signature")
+	errStore      = errors.New("duplicate or out of bounds")
+)
+
+// Every BA* message is signed by the key of its sender, the one its
+// credential carries and its peer id is derived from, its ephemeral
+// signatures by the participation key of the step, see PartKey. The
+// signatures bind what they cover to the round and step of the message,
+// so that they can't be replayed in another one.
+
+// signData signs data with our key
+func signData(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	sign, _ := ecdsa.SignASN1(rand.Reader, PRIV, hash[:])
+	return sign
+}
+
+// senderKey returns the public key pub, if id is derived from it
+func senderKey(id peer.ID, pub []byte) (crypto.PubKey, bool) {
+	key, err := crypto.UnmarshalPublicKey(pub)
+	if err != nil {
+		return nil, false
+	}
+	if pid, err := peer.IDFromPublicKey(key); err != nil || pid != id {
+		return nil, false
+	}
+	return key, true
+}
+
+// isSignValid checks that sign is the signature of data under key
+func isSignValid(key crypto.PubKey, data []byte, sign []byte) bool {
+	isValid, err := key.Verify(data, sign)
+	return err == nil && isValid
+}
+
+// checkProducer checks that block comes from a proposer of its round:
+// its credential selects the producer out of stake for seed, the seed of
+// the round, which the producer signed, and so did it the header of block.
+// It returns the producer's key.
+func checkProducer(block Block, seed string, stake StakeTable) (crypto.PubKey, error) {
+	id := block.SSeed.PeerID
+	if block.SSeed.Seed != seed {
+		return nil, errCredential
+	}
+	if _, isValid := verifyCredential(id, block.Cred, Seed{block.Round, 1, seed}, PROPOSERS, stake); !isValid {
+		return nil, errCredential
+	}
+	key, _ := senderKey(id, block.Cred.PubKey)
+	if !isSignValid(key, []byte(block.SSeed.Seed), block.SSeed.Sign) ||
+		!isSignValid(key, headerBytes(block), block.Sign) {
+		return nil, errSignature
+	}
+	return key, nil
+}
+
+// checkProposal checks that m comes from a proposer of its round and is
+// signed by it
+func (app *App) checkProposal(m Message) error {
+	mutex.Lock()
+	seed, isKnown := app.seedFor(m.Block.Round)
+	stake, hasStake := app.stakeFor(m.Block.Round)
+	mutex.Unlock()
+	if !isKnown || !hasStake || m.Sign.Seed != seed || m.Sign.PeerID != m.Block.SSeed.PeerID {
+		return errCredential
+	}
+	key, err := checkProducer(m.Block, seed, stake)
+	if err != nil {
+		return err
+	}
+	if !isSignValid(key, []byte(m.Sign.Seed), m.Sign.Sign) ||
+		!isEphemeralValid(stake, m.Sign.PeerID, key, m.Block.Round, 1, m.PartKey,
+			[][]byte{headerBytes(m.Block)}, [][]byte{m.Esig}) {
+		return errSignature
+	}
+	return nil
+}
+
+// checkVote checks that a vote of id for the step sign names comes from
+// a committee member and returns its key and the stakes of the round
+func (app *App) checkVote(id peer.ID, sign Sign, cred Credential) (crypto.PubKey, StakeTable, error) {
+	mutex.Lock()
+	seed, isKnown := app.seedFor(sign.Seed.Round)
+	stake, hasStake := app.stakeFor(sign.Seed.Round)
+	mutex.Unlock()
+	if !isKnown || !hasStake || sign.Seed.Seed != seed || sign.Seed.Step < 2 || sign.PeerID != id {
+		return nil, stake, errCredential
+	}
+	if _, isValid := verifyCredential(id, cred, sign.Seed, COMMITTEE, stake); !isValid {
+		return nil, stake, errCredential
+	}
+	key, _ := senderKey(id, cred.PubKey)
+	if !isSignValid(key, seedBytes(sign.Seed), sign.Sign) {
+		return nil, stake, errSignature
+	}
+	return key, stake, nil
+}
+
+// checkMessage23 checks a vote of step 2 or 3
+func (app *App) checkMessage23(m Message23) error {
+	key, stake, err := app.checkVote(m.PeerID, m.Sign, m.Cred)
+	if err != nil {
+		return err
+	}
+	if !isEphemeralValid(stake, m.PeerID, key, m.Sign.Seed.Round, m.Sign.Seed.Step, m.PartKey,
+		[][]byte{valueVoteBytes(m.Sign.Seed, m.Value)}, [][]byte{m.ValueESign}) {
+		return errSignature
+	}
+	return nil
+}
+
+// checkMessage4 checks a vote of step 4 or later
+func (app *App) checkMessage4(m Message4) error {
+	key, stake, err := app.checkVote(m.PeerID, m.Sign, m.Cred)
+	if err != nil {
+		return err
+	}
+	if !isEphemeralValid(stake, m.PeerID, key, m.Sign.Seed.Round, m.Sign.Seed.Step, m.PartKey,
+		[][]byte{bitVoteBytes(m.Sign.Seed, m.Bit), valueVoteBytes(m.Sign.Seed, m.Value)},
+		[][]byte{m.BESign, m.ValueESign}) {
+		return errSignature
+	}
+	return nil
+}
+
+// dropMessage counts and logs a message of kind from that failed with err
+func dropMessage(kind string, from peer.ID, err error) {
+	mutex.Lock()
+	DROPPED[kind+": "+err.Error()]++
+	count := DROPPED[kind+": "+err.Error()]
+	mutex.Unlock()
+	log.Printf("warn: dropped %s from %s: %s (%d so far)", kind, from, err, count)
+}
@@ -0,0 +1,156 @@
+package src
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/big"
+)
+
+// ECVRF-P256-SHA256-TAI of RFC 9381 on the P-256 key of a node. Only the
+// key holder can compute the output of the VRF for an input, anyone can
+// check it against the proof. The nonce of a proof is derived from the
+// key and the input by RFC 6979, so proofs are those of the RFC too.
+
+const (
+	vrfSuite    = 0x01
+	vrfPtLen    = 33 // a compressed point
+	vrfCLen     = 16
+	vrfQLen     = 32
+	vrfProofLen = vrfPtLen + vrfCLen + vrfQLen
+)
+
+var vrfCurve = elliptic.P256()
+
+// vrfHashToCurve maps alpha to a point by try and increment, pub is the
+// compressed public key
+func vrfHashToCurve(pub []byte, alpha []byte) (*big.Int, *big.Int) {
+	for ctr := 0; ctr < 256; ctr++ {
+		h := sha256.New()
+		h.Write([]byte{vrfSuite, 0x01})
+		h.Write(pub)
+		h.Write(alpha)
+		h.Write([]byte{byte(ctr), 0x00})
+		if x, y := elliptic.UnmarshalCompressed(vrfCurve, append([]byte{0x02}, h.Sum(nil)...)); x != nil {
+			return x, y
+		}
+	}
+	return nil, nil
+}
+
+// vrfChallenge hashes the points of a proof down to its challenge
+func vrfChallenge(points ...*big.Int) *big.Int {
+	h := sha256.New()
+	h.Write([]byte{vrfSuite, 0x02})
+	for i := 0; i < len(points); i += 2 {
+		h.Write(elliptic.MarshalCompressed(vrfCurve, points[i], points[i+1]))
+	}
+	h.Write([]byte{0x00})
+	return new(big.Int).SetBytes(h.Sum(nil)[:vrfCLen])
+}
+
+// vrfNeg negates a point, (0, 0) stands for the point at infinity
+func vrfNeg(x, y *big.Int) (*big.Int, *big.Int) {
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return x, y
+	}
+	return x, new(big.Int).Sub(vrfCurve.Params().P, y)
+}
+
+// vrfOutput is the output of the VRF given the gamma point of a proof
+func vrfOutput(gamma []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{vrfSuite, 0x03})
+	h.Write(gamma)
+	h.Write([]byte{0x00})
+	return h.Sum(nil)
+}
+
+// vrfNonce derives the nonce of a proof from the secret key x and the
+// compressed point h alpha hashes to, by section 3.2 of RFC 6979
+func vrfNonce(x *big.Int, h []byte) *big.Int {
+	n := vrfCurve.Params().N
+	h1 := sha256.Sum256(h)
+	xBytes := x.FillBytes(make([]byte, vrfQLen))
+	hBytes := new(big.Int).Mod(new(big.Int).SetBytes(h1[:]), n).FillBytes(make([]byte, vrfQLen))
+	mac := func(key []byte, data ...[]byte) []byte {
+		m := hmac.New(sha256.New, key)
+		for _, d := range data {
+			m.Write(d)
+		}
+		return m.Sum(nil)
+	}
+	v := make([]byte, sha256.Size)
+	for i := range v {
+		v[i] = 0x01
+	}
+	k := make([]byte, sha256.Size)
+	k = mac(k, v, []byte{0x00}, xBytes, hBytes)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, xBytes, hBytes)
+	v = mac(k, v)
+	for {
+		v = mac(k, v)
+		if nonce := new(big.Int).SetBytes(v); nonce.Sign() > 0 && nonce.Cmp(n) < 0 {
+			return nonce
+		}
+		k = mac(k, v, []byte{0x00})
+		v = mac(k, v)
+	}
+}
+
+// vrfProve returns the output of the VRF for alpha under priv and the
+// proof of it
+func vrfProve(priv *ecdsa.PrivateKey, alpha []byte) ([]byte, []byte) {
+	n := vrfCurve.Params().N
+	pub := elliptic.MarshalCompressed(vrfCurve, priv.X, priv.Y)
+	hx, hy := vrfHashToCurve(pub, alpha)
+	gx, gy := vrfCurve.ScalarMult(hx, hy, priv.D.Bytes())
+	k := vrfNonce(priv.D, elliptic.MarshalCompressed(vrfCurve, hx, hy))
+	ux, uy := vrfCurve.ScalarBaseMult(k.Bytes())
+	vx, vy := vrfCurve.ScalarMult(hx, hy, k.Bytes())
+	c := vrfChallenge(priv.X, priv.Y, hx, hy, gx, gy, ux, uy, vx, vy)
+	s := new(big.Int).Mul(c, priv.D)
+	s.Add(s, k).Mod(s, n)
+
+	gamma := elliptic.MarshalCompressed(vrfCurve, gx, gy)
+	proof := make([]byte, vrfProofLen)
+	copy(proof, gamma)
+	c.FillBytes(proof[vrfPtLen : vrfPtLen+vrfCLen])
+	s.FillBytes(proof[vrfPtLen+vrfCLen:])
+	return vrfOutput(gamma), proof
+}
+
+// vrfVerify checks proof for alpha under pub and returns the output of
+// the VRF it proves
+func vrfVerify(pub *ecdsa.PublicKey, alpha []byte, proof []byte) ([]byte, bool) {
+	n := vrfCurve.Params().N
+	if len(proof) != vrfProofLen || pub.Curve != vrfCurve || !vrfCurve.IsOnCurve(pub.X, pub.Y) {
+		return nil, false
+	}
+	gx, gy := elliptic.UnmarshalCompressed(vrfCurve, proof[:vrfPtLen])
+	if gx == nil {
+		return nil, false
+	}
+	c := new(big.Int).SetBytes(proof[vrfPtLen : vrfPtLen+vrfCLen])
+	s := new(big.Int).SetBytes(proof[vrfPtLen+vrfCLen:])
+	if s.Cmp(n) >= 0 {
+		return nil, false
+	}
+	hx, hy := vrfHashToCurve(elliptic.MarshalCompressed(vrfCurve, pub.X, pub.Y), alpha)
+	if hx == nil {
+		return nil, false
+	}
+	// U = s*B - c*Y, V = s*H - c*Gamma
+	sbx, sby := vrfCurve.ScalarBaseMult(s.Bytes())
+	cyx, cyy := vrfNeg(vrfCurve.ScalarMult(pub.X, pub.Y, c.Bytes()))
+	ux, uy := vrfCurve.Add(sbx, sby, cyx, cyy)
+	shx, shy := vrfCurve.ScalarMult(hx, hy, s.Bytes())
+	cgx, cgy := vrfNeg(vrfCurve.ScalarMult(gx, gy, c.Bytes()))
+	vx, vy := vrfCurve.Add(shx, shy, cgx, cgy)
+	if vrfChallenge(pub.X, pub.Y, hx, hy, gx, gy, ux, uy, vx, vy).Cmp(c) != 0 {
+		return nil, false
+	}
+	return vrfOutput(proof[:vrfPtLen]), true
+}
@@ -0,0 +1,91 @@
+package src
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// vrfVector is an example of ECVRF-P256-SHA256-TAI from appendix B.1 of
+// RFC 9381
+type vrfVector struct {
+	sk    string
+	pk    string
+	alpha string
+	pi    string
+	beta  string
+}
+
+var vrfVectors = []vrfVector{
+	{
+		"c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721",
+		"0360fed4ba255a9d31c961eb74c6356d68c049b8923b61fa6ce669622e60f29fb6",
+		"73616d706c65", // "sample"
+		"035b5c726e8c0e2c488a107c600578ee75cb702343c153cb1eb8dec77f4b5071b4a53f0a46f018bc2c56e58d383f2305e0975972c26feea0eb122fe7893c15af376b33edf7de17c6ea056d4d82de6bc02f",
+		"a3ad7b0ef73d8fc6655053ea22f9bede8c743f08bbed3d38821f0e16474b505e",
+	},
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func vrfKey(t *testing.T, sk string) *ecdsa.PrivateKey {
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(decodeHex(t, sk))}
+	priv.Curve = vrfCurve
+	priv.X, priv.Y = vrfCurve.ScalarBaseMult(priv.D.Bytes())
+	return priv
+}
+
+func TestVRFVectors(t *testing.T) {
+	for _, v := range vrfVectors {
+		priv := vrfKey(t, v.sk)
+		alpha, pi, beta := decodeHex(t, v.alpha), decodeHex(t, v.pi), decodeHex(t, v.beta)
+		if pk := elliptic.MarshalCompressed(vrfCurve, priv.X, priv.Y); !bytes.Equal(pk, decodeHex(t, v.pk)) {
+			t.Fatalf("public key %x, want %s", pk, v.pk)
+		}
+		output, proof := vrfProve(priv, alpha)
+		if !bytes.Equal(proof, pi) {
+			t.Errorf("proof of %s is %x, want %s", v.alpha, proof, v.pi)
+		}
+		if !bytes.Equal(output, beta) {
+			t.Errorf("output of %s is %x, want %s", v.alpha, output, v.beta)
+		}
+		if output := vrfOutput(pi[:vrfPtLen]); !bytes.Equal(output, beta) {
+			t.Errorf("proof to hash of %s is %x, want %s", v.alpha, output, v.beta)
+		}
+		if output, isValid := vrfVerify(&priv.PublicKey, alpha, pi); !isValid || !bytes.Equal(output, beta) {
+			t.Errorf("verify of %s: %x %v, want %s true", v.alpha, output, isValid, v.beta)
+		}
+	}
+}
+
+func TestVRFRejects(t *testing.T) {
+	v := vrfVectors[0]
+	priv := vrfKey(t, v.sk)
+	other := vrfKey(t, "01")
+	alpha, pi := decodeHex(t, v.alpha), decodeHex(t, v.pi)
+	for i := 0; i < vrfProofLen; i++ {
+		proof := append([]byte{}, pi...)
+		proof[i] ^= 0x01
+		if _, isValid := vrfVerify(&priv.PublicKey, alpha, proof); isValid {
+			t.Errorf("proof with byte %d flipped verifies", i)
+		}
+	}
+	if _, isValid := vrfVerify(&priv.PublicKey, alpha, pi[:vrfProofLen-1]); isValid {
+		t.Error("short proof verifies")
+	}
+	if _, isValid := vrfVerify(&priv.PublicKey, []byte("other"), pi); isValid {
+		t.Error("proof verifies for another input")
+	}
+	if _, isValid := vrfVerify(&other.PublicKey, alpha, pi); isValid {
+		t.Error("proof verifies under another key")
+	}
+}